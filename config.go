@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "TEXTFILES_"
+
+// config is the configuration of the service
+//
+// Values are applied in order: defaults, config file, environment variables (TEXTFILES_*), then command-line flags
+type config struct {
+	Addr            string
+	Storage         string
+	Root            string
+	PathPrefix      string
+	OutputError     bool
+	MaxBodySize     int64
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	TLSCert         string
+	TLSKey          string
+	TLSClientCA     string
+	TLSSelfSigned   bool
+
+	FollowExternalSymlinks bool
+
+	Trash          bool
+	TrashRetention time.Duration
+
+	Versions         bool
+	VersionLimit     int
+	VersionRetention time.Duration
+
+	StatsWorkers int
+
+	PrintConfig bool
+}
+
+// configOption describes a config key that can be set from config file, environment variable and flag
+type configOption struct {
+	name   string
+	usage  string
+	isBool bool
+}
+
+// configFlag is a flag.Value of a config key, the value is applied after config file and environment variables
+type configFlag struct {
+	name   string
+	value  string
+	isBool bool
+}
+
+func (f *configFlag) String() string   { return f.value }
+func (f *configFlag) IsBoolFlag() bool { return f.isBool }
+
+func (f *configFlag) Set(value string) error {
+	if err := defaultConfig().set(f.name, value); err != nil {
+		return err
+	}
+	f.value = value
+	return nil
+}
+
+var configOptions = []configOption{
+	{"addr", "listen address", false},
+	{"storage", "storage backend, disk or memory", false},
+	{"root", "root folder that holds text files, used by disk storage", false},
+	{"prefix", "URL path prefix of the API", false},
+	{"output-error", "output panic errors and stack traces in responses", true},
+	{"max-body-size", "maximum request body size in bytes (supports KB, MB, GB suffixes), 0 means unlimited", false},
+	{"read-timeout", "maximum duration for reading the entire request, 0 means no timeout", false},
+	{"write-timeout", "maximum duration before timing out writes of the response, 0 means no timeout", false},
+	{"idle-timeout", "maximum duration to wait for the next request when keep-alives are enabled", false},
+	{"shutdown-timeout", "maximum duration to wait for in-flight requests when shutting down", false},
+	{"tls-cert", "TLS certificate file (PEM), reloaded when modified", false},
+	{"tls-key", "TLS private key file (PEM), reloaded when modified", false},
+	{"tls-client-ca", "CA bundle file (PEM) to verify client certificates, enables mutual TLS", false},
+	{"tls-self-signed", "serve TLS with a self-signed certificate generated at startup, for development", true},
+	{"follow-external-symlinks", "allow symbolic links under root pointing outside of root, used by disk storage", true},
+	{"trash", "move deleted files to trash, which can be restored", true},
+	{"trash-retention", "duration to keep files in trash before purged, 0 means forever", false},
+	{"versions", "keep prior revisions of files when modified, which can be retrieved and rolled back to", true},
+	{"version-limit", "number of revisions to keep per file, 0 means unlimited", false},
+	{"version-retention", "duration to keep revisions before purged, 0 means forever", false},
+	{"stats-workers", "number of files read in parallel for statistics, 0 means the number of CPUs", false},
+}
+
+// defaultConfig returns the config with default values
+func defaultConfig() *config {
+	return &config{
+		Addr:        ":8080",
+		Storage:     "disk",
+		Root:        "./files",
+		PathPrefix:  "/",
+		OutputError: true,
+		MaxBodySize: 10 << 20,
+
+		ReadTimeout:     time.Minute,
+		WriteTimeout:    time.Minute,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+
+		Trash:          true,
+		TrashRetention: 30 * 24 * time.Hour,
+
+		Versions:     true,
+		VersionLimit: 20,
+	}
+}
+
+// loadConfig loads the config from command-line arguments (without program name), environment variables and the config file
+//
+// The config file is set by -config flag or TEXTFILES_CONFIG environment variable
+func loadConfig(args []string, getenv func(string) string) (*config, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("text-files-service", flag.ContinueOnError)
+	fileName := fs.String("config", getenv(envPrefix+"CONFIG"), "config file, JSON or \"key: value\" lines")
+	fs.BoolVar(&c.PrintConfig, "print-config", false, "print the effective config and exit")
+	flags := map[string]*configFlag{}
+	for _, o := range configOptions {
+		flags[o.name] = &configFlag{o.name, c.get(o.name), o.isBool}
+		fs.Var(flags[o.name], o.name, o.usage+" (env "+envName(o.name)+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	if len(*fileName) > 0 {
+		b, err := ioutil.ReadFile(*fileName)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseConfigFile(b)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %v", *fileName, err)
+		}
+		for _, e := range entries {
+			if err := c.set(e[0], e[1]); err != nil {
+				return nil, fmt.Errorf("config file %s: %v", *fileName, err)
+			}
+		}
+	}
+
+	for _, o := range configOptions {
+		if v := getenv(envName(o.name)); len(v) > 0 {
+			if err := c.set(o.name, v); err != nil {
+				return nil, fmt.Errorf("env %s: %v", envName(o.name), err)
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := flags[f.Name]; ok {
+			// Values are checked by configFlag.Set
+			c.set(f.Name, v.value)
+		}
+	})
+
+	return c, c.validate()
+}
+
+// envName returns the environment variable name of the config key
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func (c *config) get(name string) string {
+	switch name {
+	case "addr":
+		return c.Addr
+	case "storage":
+		return c.Storage
+	case "root":
+		return c.Root
+	case "prefix":
+		return c.PathPrefix
+	case "output-error":
+		return strconv.FormatBool(c.OutputError)
+	case "max-body-size":
+		return strconv.FormatInt(c.MaxBodySize, 10)
+	case "read-timeout":
+		return c.ReadTimeout.String()
+	case "write-timeout":
+		return c.WriteTimeout.String()
+	case "idle-timeout":
+		return c.IdleTimeout.String()
+	case "shutdown-timeout":
+		return c.ShutdownTimeout.String()
+	case "tls-cert":
+		return c.TLSCert
+	case "tls-key":
+		return c.TLSKey
+	case "tls-client-ca":
+		return c.TLSClientCA
+	case "tls-self-signed":
+		return strconv.FormatBool(c.TLSSelfSigned)
+	case "follow-external-symlinks":
+		return strconv.FormatBool(c.FollowExternalSymlinks)
+	case "trash":
+		return strconv.FormatBool(c.Trash)
+	case "trash-retention":
+		return c.TrashRetention.String()
+	case "versions":
+		return strconv.FormatBool(c.Versions)
+	case "version-limit":
+		return strconv.Itoa(c.VersionLimit)
+	case "version-retention":
+		return c.VersionRetention.String()
+	case "stats-workers":
+		return strconv.Itoa(c.StatsWorkers)
+	}
+	return ""
+}
+
+func (c *config) set(name, value string) (err error) {
+	switch name {
+	case "addr":
+		c.Addr = value
+	case "storage":
+		c.Storage = value
+	case "root":
+		c.Root = value
+	case "prefix":
+		c.PathPrefix = value
+	case "output-error":
+		c.OutputError, err = strconv.ParseBool(value)
+	case "max-body-size":
+		c.MaxBodySize, err = parseSize(value)
+	case "read-timeout":
+		c.ReadTimeout, err = time.ParseDuration(value)
+	case "write-timeout":
+		c.WriteTimeout, err = time.ParseDuration(value)
+	case "idle-timeout":
+		c.IdleTimeout, err = time.ParseDuration(value)
+	case "shutdown-timeout":
+		c.ShutdownTimeout, err = time.ParseDuration(value)
+	case "tls-cert":
+		c.TLSCert = value
+	case "tls-key":
+		c.TLSKey = value
+	case "tls-client-ca":
+		c.TLSClientCA = value
+	case "tls-self-signed":
+		c.TLSSelfSigned, err = strconv.ParseBool(value)
+	case "follow-external-symlinks":
+		c.FollowExternalSymlinks, err = strconv.ParseBool(value)
+	case "trash":
+		c.Trash, err = strconv.ParseBool(value)
+	case "trash-retention":
+		c.TrashRetention, err = time.ParseDuration(value)
+	case "versions":
+		c.Versions, err = strconv.ParseBool(value)
+	case "version-limit":
+		c.VersionLimit, err = strconv.Atoi(value)
+	case "version-retention":
+		c.VersionRetention, err = time.ParseDuration(value)
+	case "stats-workers":
+		c.StatsWorkers, err = strconv.Atoi(value)
+	default:
+		err = fmt.Errorf("unknown key: %s", name)
+	}
+	return err
+}
+
+func (c *config) validate() error {
+	switch c.Storage {
+	case "disk":
+		if len(c.Root) <= 0 {
+			return errors.New("root should not be empty")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("unknown storage: %s", c.Storage)
+	}
+	if !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("prefix should start with /: %s", c.PathPrefix)
+	}
+	if c.MaxBodySize < 0 {
+		return errors.New("max-body-size should not be negative")
+	}
+	for _, d := range []time.Duration{c.ReadTimeout, c.WriteTimeout, c.IdleTimeout, c.ShutdownTimeout} {
+		if d < 0 {
+			return errors.New("timeouts should not be negative")
+		}
+	}
+	if c.TrashRetention < 0 {
+		return errors.New("trash-retention should not be negative")
+	}
+	if c.VersionLimit < 0 {
+		return errors.New("version-limit should not be negative")
+	} else if c.VersionRetention < 0 {
+		return errors.New("version-retention should not be negative")
+	}
+	if c.StatsWorkers < 0 {
+		return errors.New("stats-workers should not be negative")
+	}
+	if (len(c.TLSCert) > 0) != (len(c.TLSKey) > 0) {
+		return errors.New("tls-cert and tls-key should be set together")
+	}
+	if c.TLSSelfSigned && len(c.TLSCert) > 0 {
+		return errors.New("tls-self-signed should not be set with tls-cert")
+	}
+	if len(c.TLSClientCA) > 0 && !c.TLSSelfSigned && len(c.TLSCert) <= 0 {
+		return errors.New("tls-client-ca requires tls-cert or tls-self-signed")
+	}
+	return nil
+}
+
+// versionPolicy returns the retention policy of revisions, or nil if revisions are not kept
+func (c *config) versionPolicy() *versionPolicy {
+	if !c.Versions {
+		return nil
+	}
+	return &versionPolicy{limit: c.VersionLimit, retention: c.VersionRetention}
+}
+
+// newStorage returns the Storage described by the config
+func (c *config) newStorage() Storage {
+	if c.Storage == "memory" {
+		return NewMemoryStorage()
+	}
+	return NewDiskStorage(c.Root, c.FollowExternalSymlinks)
+}
+
+// print writes the config in "key: value" lines, which can be used as config file
+func (c *config) print(w io.Writer) error {
+	for _, o := range configOptions {
+		if _, err := fmt.Fprintf(w, "%s: %s\n", o.name, c.get(o.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSize parses bytes with optional KB, MB, GB suffixes, e.g. 512, 64KB, 10MB
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for i, suffix := range []string{"KB", "MB", "GB"} {
+		if strings.HasSuffix(s, suffix) {
+			unit = 1 << (10 * uint(i+1))
+			s = strings.TrimSpace(strings.TrimSuffix(s, suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(s, "B"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * unit, nil
+}
+
+// parseConfigFile parses a JSON object, or "key: value" (or "key = value") lines with # comments, to key-value pairs
+func parseConfigFile(b []byte) ([][2]string, error) {
+	entries := make([][2]string, 0)
+	if trimmed := bytes.TrimSpace(b); bytes.HasPrefix(trimmed, []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.UseNumber()
+		m := map[string]interface{}{}
+		if err := decoder.Decode(&m); err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			switch v.(type) {
+			case string, bool, json.Number:
+			default:
+				return nil, fmt.Errorf("unexpected value of %s: %v", k, v)
+			}
+			entries = append(entries, [2]string{k, fmt.Sprint(v)})
+		}
+		return entries, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) <= 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, ":=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", n)
+		}
+		k := strings.TrimSpace(line[:i])
+		v := strings.TrimSpace(line[i+1:])
+		if l := len(v); l >= 2 && (v[0] == '"' && v[l-1] == '"' || v[0] == '\'' && v[l-1] == '\'') {
+			v = v[1 : l-1]
+		}
+		entries = append(entries, [2]string{k, v})
+	}
+	return entries, scanner.Err()
+}
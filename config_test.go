@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonFile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(jsonFile, ([]byte)(`{"addr": ":9000", "root": "/data", "output-error": false, "max-body-size": 1024}`), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	yamlFile := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(yamlFile, ([]byte)(`
+# comment
+addr: ":9001"
+prefix = /api
+max-body-size: 2MB
+`), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	testFunc := func(args []string, env map[string]string, expect func(c *config) bool) {
+		c, err := loadConfig(args, func(k string) string { return env[k] })
+		if err != nil {
+			t.Errorf("Load failed, args: %v, env: %v, %v", args, env, err)
+		} else if !expect(c) {
+			t.Errorf("Unexpected config, args: %v, env: %v, got: %+v", args, env, *c)
+		}
+	}
+
+	testFunc(nil, nil, func(c *config) bool { return *c == *defaultConfig() })
+	testFunc([]string{"-config", jsonFile}, nil, func(c *config) bool {
+		return c.Addr == ":9000" && c.Root == "/data" && !c.OutputError && c.MaxBodySize == 1024 && c.PathPrefix == "/"
+	})
+	testFunc(nil, map[string]string{"TEXTFILES_CONFIG": yamlFile}, func(c *config) bool {
+		return c.Addr == ":9001" && c.PathPrefix == "/api" && c.MaxBodySize == 2<<20
+	})
+	testFunc([]string{"-config", jsonFile}, map[string]string{"TEXTFILES_ADDR": ":9002", "TEXTFILES_STORAGE": "memory"}, func(c *config) bool {
+		return c.Addr == ":9002" && c.Root == "/data" && c.Storage == "memory"
+	})
+	testFunc([]string{"-config", jsonFile, "-addr", ":9003", "-output-error=true"}, map[string]string{"TEXTFILES_ADDR": ":9002"}, func(c *config) bool {
+		return c.Addr == ":9003" && c.OutputError
+	})
+	testFunc([]string{"-print-config"}, nil, func(c *config) bool { return c.PrintConfig })
+	testFunc([]string{"-follow-external-symlinks", "-output-error=false"}, nil, func(c *config) bool {
+		return c.FollowExternalSymlinks && !c.OutputError
+	})
+	testFunc([]string{"-trash=false", "-trash-retention", "24h"}, nil, func(c *config) bool {
+		return !c.Trash && c.TrashRetention == 24*time.Hour
+	})
+	testFunc([]string{"-version-limit", "5"}, map[string]string{"TEXTFILES_VERSION_RETENTION": "168h"}, func(c *config) bool {
+		return c.Versions && c.VersionLimit == 5 && c.VersionRetention == 7*24*time.Hour
+	})
+	testFunc(nil, map[string]string{"TEXTFILES_STATS_WORKERS": "4"}, func(c *config) bool { return c.StatsWorkers == 4 })
+
+	testErr := func(args []string, env map[string]string) {
+		if _, err := loadConfig(args, func(k string) string { return env[k] }); err == nil {
+			t.Errorf("Should fail, args: %v, env: %v", args, env)
+		}
+	}
+
+	testErr([]string{"-storage", "cloud"}, nil)
+	testErr([]string{"-prefix", "api"}, nil)
+	testErr([]string{"-max-body-size", "-1"}, nil)
+	testErr([]string{"extra"}, nil)
+	testErr([]string{"-read-timeout", "-1s"}, nil)
+	testErr([]string{"-read-timeout", "soon"}, nil)
+	testErr([]string{"-tls-cert", "cert.pem"}, nil)
+	testErr([]string{"-tls-cert", "cert.pem", "-tls-key", "key.pem", "-tls-self-signed"}, nil)
+	testErr([]string{"-tls-client-ca", "ca.pem"}, nil)
+	testErr(nil, map[string]string{"TEXTFILES_OUTPUT_ERROR": "maybe"})
+	testErr([]string{"-trash-retention", "-1h"}, nil)
+	testErr([]string{"-version-limit", "-1"}, nil)
+	testErr([]string{"-version-limit", "many"}, nil)
+	testErr([]string{"-stats-workers", "-1"}, nil)
+	testErr([]string{"-config", filepath.Join(dir, "none.json")}, nil)
+}
+
+func TestParseConfigFile(t *testing.T) {
+	testFunc := func(data string, expect map[string]string) {
+		entries, err := parseConfigFile(([]byte)(data))
+		if expect == nil {
+			if err == nil {
+				t.Errorf("Should fail, data: %s", data)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("Parse failed, data: %s, %v", data, err)
+			return
+		}
+		if len(entries) != len(expect) {
+			t.Errorf("Unexpected entries, data: %s, want: %v, got: %v", data, expect, entries)
+		}
+		for _, e := range entries {
+			if expect[e[0]] != e[1] {
+				t.Errorf("Unexpected value of %s, want: %s, got: %s", e[0], expect[e[0]], e[1])
+			}
+		}
+	}
+
+	testFunc(`{"addr":":80","output-error":true,"max-body-size":100}`, map[string]string{"addr": ":80", "output-error": "true", "max-body-size": "100"})
+	testFunc(`{"addr":[]}`, nil)
+	testFunc(`{"addr":`, nil)
+	testFunc("addr: ':80'\n\n# root: x\nroot = \"/a b\"", map[string]string{"addr": ":80", "root": "/a b"})
+	testFunc("addr", nil)
+}
+
+func TestParseSize(t *testing.T) {
+	testFunc := func(s string, expect int64, expectErr bool) {
+		n, err := parseSize(s)
+		if (err != nil) != expectErr {
+			t.Errorf("Unexpected error, size: %s, %v", s, err)
+		} else if n != expect {
+			t.Errorf("Unexpected size, %s, want: %d, got: %d", s, expect, n)
+		}
+	}
+
+	testFunc("0", 0, false)
+	testFunc("512", 512, false)
+	testFunc("512B", 512, false)
+	testFunc("64KB", 64<<10, false)
+	testFunc("10mb", 10<<20, false)
+	testFunc("1 GB", 1<<30, false)
+	testFunc("ten", 0, true)
+	testFunc("", 0, true)
+}
+
+func TestPrintConfig(t *testing.T) {
+	c := defaultConfig()
+	c.Addr = ":9999"
+	buf := &bytes.Buffer{}
+	if err := c.print(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := parseConfigFile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := defaultConfig()
+	for _, e := range entries {
+		if err := loaded.set(e[0], e[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *loaded != *c {
+		t.Errorf("Printed config should be loadable, want: %+v, got: %+v", *c, *loaded)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// diffContext is the number of context lines around changes in unified diff
+	diffContext = 3
+
+	// maxDiffEdits bounds the work of diffLines, content with more edits is diffed as a whole replacement
+	maxDiffEdits = 1000
+)
+
+// splitLines splits the content into lines, each line keeps its "\n"
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if len(lines[len(lines)-1]) <= 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the lines of the edit script from a to b, computed by Myers' algorithm
+//
+// Lines of a and b keep their "\n", so a last line without "\n" differs from the same line with "\n"
+func diffLines(a, b []string) []diffLine {
+	// Common prefix and suffix are kept as is
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	result := make([]diffLine, 0, len(a)+len(b))
+	for _, l := range a[:prefix] {
+		result = append(result, newDiffLine(' ', l))
+	}
+	result = append(result, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, l := range a[len(a)-suffix:] {
+		result = append(result, newDiffLine(' ', l))
+	}
+	return result
+}
+
+func newDiffLine(op byte, line string) diffLine {
+	return diffLine{op: op, text: strings.TrimSuffix(line, "\n"), newline: strings.HasSuffix(line, "\n")}
+}
+
+// myersDiff returns the shortest edit script from a to b, or removes a then adds b if it needs more than maxDiffEdits edits
+func myersDiff(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+
+	// v[offset+k] is the furthest x on diagonal k, trace[d] is v of diagonals -d to d before step d
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := make([][]int, 0)
+	found := -1
+	for d := 0; d <= max && found < 0; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = d
+				break
+			}
+		}
+	}
+
+	if found < 0 {
+		result := make([]diffLine, 0, n+m)
+		for _, l := range a {
+			result = append(result, newDiffLine('-', l))
+		}
+		for _, l := range b {
+			result = append(result, newDiffLine('+', l))
+		}
+		return result
+	}
+
+	// Backtrack from the end, lines are collected in reverse
+	reversed := make([]diffLine, 0, n+m)
+	x, y := n, m
+	for d := found; d > 0; d-- {
+		prev := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+			prevK = k + 1
+		}
+		prevX := prev[prevK+d]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, newDiffLine(' ', a[x-1]))
+			x--
+			y--
+		}
+		if x == prevX {
+			reversed = append(reversed, newDiffLine('+', b[y-1]))
+			y--
+		} else {
+			reversed = append(reversed, newDiffLine('-', a[x-1]))
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, newDiffLine(' ', a[x-1]))
+		x--
+		y--
+	}
+
+	result := make([]diffLine, len(reversed))
+	for i, l := range reversed {
+		result[len(reversed)-1-i] = l
+	}
+	return result
+}
+
+// writeUnifiedDiff writes the unified diff from a to b, which can be applied by PATCH. Nothing is written if they are the same
+func writeUnifiedDiff(w io.Writer, fromName, toName, a, b string) error {
+	lines := diffLines(splitLines(a), splitLines(b))
+	oldLine, newLine := 1, 1
+	headerWritten := false
+	for i := 0; i < len(lines); {
+		change := i
+		for change < len(lines) && lines[change].op == ' ' {
+			change++
+		}
+		if change >= len(lines) {
+			break
+		}
+
+		// Hunks are merged if context lines between changes are no more than twice diffContext
+		last := change
+		for j := change + 1; j < len(lines); j++ {
+			if lines[j].op != ' ' {
+				last = j
+			} else if j-last > 2*diffContext {
+				break
+			}
+		}
+		start := change - diffContext
+		if start < i {
+			start = i
+		}
+		end := last + 1 + diffContext
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		oldLine += start - i
+		newLine += start - i
+		h := lines[start:end]
+		oldLines, newLines := 0, 0
+		for _, l := range h {
+			if l.op != '+' {
+				oldLines++
+			}
+			if l.op != '-' {
+				newLines++
+			}
+		}
+
+		if !headerWritten {
+			if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", fromName, toName); err != nil {
+				return err
+			}
+			headerWritten = true
+		}
+		if _, err := fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(oldLine, oldLines), hunkRange(newLine, newLines)); err != nil {
+			return err
+		}
+		for _, l := range h {
+			s := string(l.op) + l.text + "\n"
+			if !l.newline {
+				s += "\\ No newline at end of file\n"
+			}
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		}
+
+		oldLine += oldLines
+		newLine += newLines
+		i = end
+	}
+	return nil
+}
+
+// hunkRange formats the range of hunk header, the start of an empty range is the line before it
+func hunkRange(start, lines int) string {
+	if lines == 0 {
+		start--
+	}
+	if lines == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
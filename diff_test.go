@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	testFunc := func(a, b string) {
+		diff := bytes.Buffer{}
+		if err := writeUnifiedDiff(&diff, "a", "b", a, b); err != nil {
+			t.Fatal(err)
+		}
+		if a == b {
+			if diff.Len() != 0 {
+				t.Errorf("Unexpected diff, want: empty, got: %q", diff.String())
+			}
+			return
+		}
+
+		hunks, err := parseUnifiedDiff(diff.String())
+		if err != nil {
+			t.Errorf("Unexpected error, a: %q, b: %q, diff: %q, got: %v", a, b, diff.String(), err)
+			return
+		}
+		patched := bytes.Buffer{}
+		if err := applyDiff(&patched, strings.NewReader(a), hunks); err != nil || patched.String() != b {
+			t.Errorf("Unexpected patched content, a: %q, diff: %q, want: %q, got: %q, %v", a, diff.String(), b, patched.String(), err)
+		}
+	}
+
+	testFunc("", "")
+	testFunc("a\nb\n", "a\nb\n")
+	testFunc("", "a\n")
+	testFunc("a\n", "")
+	testFunc("a\nb\nc\n", "a\nc\n")
+	testFunc("a\nb\nc\n", "x\na\nb\nc\ny\n")
+	testFunc("a\nb", "a\nb\n")
+	testFunc("a\nb\n", "a\nc")
+	testFunc("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n", "1\nx\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\ny\n15\n")
+	testFunc("1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\nx\n3\n4\n5\n6\n7\ny\n9\n")
+	testFunc("a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n")
+
+	// More edits than maxDiffEdits are diffed as a whole replacement
+	a, b := strings.Builder{}, strings.Builder{}
+	for i := 0; i < maxDiffEdits; i++ {
+		a.WriteString("a\n")
+		b.WriteString("b\n")
+	}
+	testFunc(a.String(), b.String())
+
+	diff := bytes.Buffer{}
+	if err := writeUnifiedDiff(&diff, "/news/today@1", "/news/today@2", "a\nb\nc\n", "a\nx\nc"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "--- /news/today@1\n+++ /news/today@2\n@@ -1,3 +1,3 @@\n a\n-b\n-c\n+x\n+c\n\\ No newline at end of file\n"
+	if diff.String() != expect {
+		t.Errorf("Unexpected diff, want: %q, got: %q", expect, diff.String())
+	}
+}
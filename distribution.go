@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/montanaflynn/stats"
+)
+
+// distribution is the extended statistics of values, percentiles are by nearest rank
+//
+// Quartiles are medians of the halves, which exclude the median if the number of values is odd. Quartiles of a single value are the value
+type distribution struct {
+	Min       float64
+	Max       float64
+	Median    float64
+	P90       float64
+	P99       float64
+	Quartiles stats.Quartiles
+}
+
+// histogramBin is the number of values from Min to Max (inclusive)
+type histogramBin struct {
+	Min   int64
+	Max   int64
+	Count int
+}
+
+// newDistribution returns the distribution of values, or nil if there are no values
+func newDistribution(values []float64) *distribution {
+	if len(values) <= 0 {
+		return nil
+	}
+	d := &distribution{}
+	d.Min, _ = stats.Min(values)
+	d.Max, _ = stats.Max(values)
+	d.Median, _ = stats.Median(values)
+	d.P90, _ = stats.PercentileNearestRank(values, 90)
+	d.P99, _ = stats.PercentileNearestRank(values, 99)
+	if len(values) > 1 {
+		d.Quartiles, _ = stats.Quartile(values)
+	} else {
+		// Halves are empty, of which stats.Quartile returns NaN that JSON cannot encode
+		d.Quartiles = stats.Quartiles{Q1: values[0], Q2: values[0], Q3: values[0]}
+	}
+	return d
+}
+
+// countsDistribution returns the distribution of small integers counted by value (counts[v] is the number of v),
+// which is the same as newDistribution of the values without expanding them, or nil if there are no values
+func countsDistribution(counts []int) *distribution {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	// at returns the i-th smallest value
+	at := func(i int) float64 {
+		for v, c := range counts {
+			if i < c {
+				return float64(v)
+			}
+			i -= c
+		}
+		return math.NaN()
+	}
+	// median returns the median of values from the i-th to the j-th smallest (exclusive), as stats.Median
+	median := func(i, j int) float64 {
+		l := j - i
+		if l%2 == 0 {
+			return (at(i+l/2-1) + at(i+l/2)) / 2
+		}
+		return at(i + l/2)
+	}
+	// nearestRank returns the percentile as stats.PercentileNearestRank
+	nearestRank := func(percent float64) float64 {
+		rank := int(math.Ceil(float64(n) * percent / 100))
+		if rank <= 0 {
+			rank = 1
+		}
+		return at(rank - 1)
+	}
+
+	d := &distribution{
+		Min:    at(0),
+		Max:    at(n - 1),
+		Median: median(0, n),
+		P90:    nearestRank(90),
+		P99:    nearestRank(99),
+	}
+	if n > 1 {
+		// Halves exclude the middle value if the number of values is odd, as stats.Quartile
+		lower, upper := n/2, n/2
+		if n%2 != 0 {
+			lower, upper = (n-1)/2, (n+1)/2
+		}
+		d.Quartiles = stats.Quartiles{Q1: median(0, lower), Q2: d.Median, Q3: median(upper, n)}
+	} else {
+		d.Quartiles = stats.Quartiles{Q1: d.Min, Q2: d.Min, Q3: d.Min}
+	}
+	return d
+}
+
+// countsHistogram returns the histogram of small integers counted by value, a bin per value counted
+func countsHistogram(counts []int) []histogramBin {
+	bins := make([]histogramBin, 0)
+	for v, c := range counts {
+		if c > 0 {
+			bins = append(bins, histogramBin{int64(v), int64(v), c})
+		}
+	}
+	return bins
+}
+
+// sizeHistogram returns the histogram of sizes in bins of powers of 2, e.g. 0, 1, 2-3, 4-7, ..., 1024-2047, only bins not empty are returned
+func sizeHistogram(sizes []int64) []histogramBin {
+	counts := make([]int, 65)
+	for _, size := range sizes {
+		counts[bits.Len64(uint64(size))]++
+	}
+	bins := make([]histogramBin, 0)
+	for i, c := range counts {
+		if c <= 0 {
+			continue
+		}
+		if i == 0 {
+			bins = append(bins, histogramBin{0, 0, c})
+			continue
+		}
+		bins = append(bins, histogramBin{int64(1) << uint(i-1), int64(uint64(1)<<uint(i) - 1), c})
+	}
+	return bins
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCountsDistribution(t *testing.T) {
+	testFunc := func(counts []int) {
+		values := make([]float64, 0)
+		for v, c := range counts {
+			for i := 0; i < c; i++ {
+				values = append(values, float64(v))
+			}
+		}
+		// Values are expanded in order, reverse them so newDistribution sorts
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+
+		want, got := newDistribution(values), countsDistribution(counts)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("Unexpected distribution, counts: %v, want: %+v, got: %+v", counts, want, got)
+		}
+		if got == nil {
+			return
+		}
+		if _, err := json.Marshal(got); err != nil {
+			t.Errorf("Unexpected error, counts: %v, got: %v", counts, err)
+		}
+	}
+
+	testFunc(nil)
+	testFunc([]int{0, 0, 0})
+	testFunc([]int{0, 1})
+	testFunc([]int{0, 0, 2})
+	testFunc([]int{0, 1, 1})
+	testFunc([]int{0, 1, 1, 1})
+	testFunc([]int{0, 2, 0, 1, 1})
+	testFunc([]int{1, 3, 5, 2, 0, 0, 1})
+	testFunc([]int{0, 40, 30, 20, 9, 0, 0, 0, 0, 0, 0, 0, 1})
+	testFunc([]int{0, 100, 0, 0, 1, 2})
+}
+
+func TestNewDistribution(t *testing.T) {
+	d := newDistribution([]float64{7, 1, 3, 100, 5})
+	want := &distribution{Min: 1, Max: 100, Median: 5, P90: 100, P99: 100}
+	want.Quartiles.Q1, want.Quartiles.Q2, want.Quartiles.Q3 = 2, 5, 53.5
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("Unexpected distribution, want: %+v, got: %+v", want, d)
+	}
+	if d := newDistribution(nil); d != nil {
+		t.Errorf("Unexpected distribution of no values, want: nil, got: %+v", d)
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	testFunc := func(sizes []int64, expect []histogramBin) {
+		if got := sizeHistogram(sizes); !reflect.DeepEqual(got, expect) {
+			t.Errorf("Unexpected histogram, sizes: %v, want: %v, got: %v", sizes, expect, got)
+		}
+	}
+
+	testFunc(nil, []histogramBin{})
+	testFunc([]int64{0, 0, 1}, []histogramBin{{0, 0, 2}, {1, 1, 1}})
+	testFunc([]int64{2, 3, 4, 7, 8}, []histogramBin{{2, 3, 2}, {4, 7, 2}, {8, 15, 1}})
+	testFunc([]int64{1023, 1024, 2047, 1 << 20}, []histogramBin{{512, 1023, 1}, {1024, 2047, 2}, {1 << 20, 1<<21 - 1, 1}})
+}
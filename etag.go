@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newETagHash returns the hash used by ETags
+func newETagHash() hash.Hash {
+	return sha256.New()
+}
+
+// hashETag returns the strong ETag of the hash, a quoted hex digest
+func hashETag(h hash.Hash) string {
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// contentETag returns the strong ETag of the content
+func contentETag(b []byte) string {
+	h := newETagHash()
+	h.Write(b)
+	return hashETag(h)
+}
+
+// fileETag returns the strong ETag of the named file content
+func fileETag(store Storage, name string) (string, error) {
+	f, err := store.Get(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newETagHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hashETag(h), nil
+}
+
+// etagMatch returns a boolean indicating whether the header value (a list of ETags, or "*") matches the ETag
+//
+// Weak comparison ignores the W/ prefix, it is used by If-None-Match; strong comparison is used by If-Match
+func etagMatch(header, etag string, weak bool) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" {
+			return true
+		}
+		if weak {
+			v = strings.TrimPrefix(v, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		} else if strings.HasPrefix(v, "W/") || strings.HasPrefix(etag, "W/") {
+			continue
+		}
+		if v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setValidators sets ETag and Last-Modified response headers
+func setValidators(w http.ResponseWriter, etag string, modTime time.Time) {
+	if len(etag) > 0 {
+		w.Header().Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified returns a boolean indicating whether the request validators (If-None-Match, or If-Modified-Since when If-None-Match is absent) match the current version
+func notModified(req *http.Request, etag string, modTime time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); len(inm) > 0 {
+		return etagMatch(inm, etag, true)
+	}
+	if ims := req.Header.Get("If-Modified-Since"); len(ims) > 0 && !modTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !modTime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// ifMatchMiddleware is a middleware that checks If-Match request header against the ETag of the file, the path is from Context()
+//
+// If ETag does not match, it will response http.StatusPreconditionFailed with current ETag.
+//
+// Note: Must pass filePathMiddleware and fileExistsMiddleware, and should pass lockMiddleware
+func ifMatchMiddleware(store Storage, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fileName := req.Context().Value(keyFileName).(string)
+		if !checkIfMatch(w, req, store, fileName) {
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// checkIfMatch checks If-Match request header against the ETag of the named file
+//
+// If ETag does not match, it responses http.StatusPreconditionFailed with current ETag and returns false
+func checkIfMatch(w http.ResponseWriter, req *http.Request, store Storage, name string) bool {
+	im := req.Header.Get("If-Match")
+	if len(im) <= 0 {
+		return true
+	}
+	etag, err := fileETag(store, name)
+	if err != nil {
+		panic(err)
+	}
+	if !etagMatch(im, etag, false) {
+		w.Header().Set("ETag", etag)
+		ren.JSON(w, http.StatusPreconditionFailed, responseError{"Precondition failed, ETag does not match"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestETagMatch(t *testing.T) {
+	testFunc := func(header, etag string, weak, expect bool) {
+		if m := etagMatch(header, etag, weak); m != expect {
+			t.Errorf("Unexpected match, header: %s, etag: %s, weak: %v, want: %v, got: %v", header, etag, weak, expect, m)
+		}
+	}
+
+	testFunc(`"abc"`, `"abc"`, false, true)
+	testFunc(`"abc"`, `"abd"`, false, false)
+	testFunc(`"x", "abc"`, `"abc"`, false, true)
+	testFunc(`"x","y"`, `"abc"`, false, false)
+	testFunc(`*`, `"abc"`, false, true)
+	testFunc(`W/"abc"`, `"abc"`, false, false)
+	testFunc(`W/"abc"`, `"abc"`, true, true)
+	testFunc(`abc`, `"abc"`, true, false)
+	testFunc(``, `"abc"`, true, false)
+}
+
+func TestNotModified(t *testing.T) {
+	modTime := time.Date(2018, 6, 1, 10, 0, 0, 500, time.UTC)
+	testFunc := func(header map[string]string, expect bool) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		if m := notModified(req, `"abc"`, modTime); m != expect {
+			t.Errorf("Unexpected result, header: %v, want: %v, got: %v", header, expect, m)
+		}
+	}
+
+	testFunc(nil, false)
+	testFunc(map[string]string{"If-None-Match": `"abc"`}, true)
+	testFunc(map[string]string{"If-None-Match": `W/"abc"`}, true)
+	testFunc(map[string]string{"If-None-Match": `"abd"`}, false)
+	testFunc(map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)}, true)
+	testFunc(map[string]string{"If-Modified-Since": modTime.Add(time.Hour).Format(http.TimeFormat)}, true)
+	testFunc(map[string]string{"If-Modified-Since": modTime.Add(-time.Second).Format(http.TimeFormat)}, false)
+	testFunc(map[string]string{"If-Modified-Since": "yesterday"}, false)
+	testFunc(map[string]string{"If-None-Match": `"abd"`, "If-Modified-Since": modTime.Format(http.TimeFormat)}, false)
+}
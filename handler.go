@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 )
 
@@ -21,6 +27,8 @@ type key int
 const (
 	keyFileName key = iota
 	keyContent
+	keyPatch
+	keyDestination
 )
 
 const (
@@ -29,6 +37,11 @@ const (
 
 var ren = render.New()
 
+var (
+	errBodyTooLarge = errors.New("request body too large")
+	errInvalidText  = errors.New("invalid utf-8 text")
+)
+
 type responseError struct {
 	Error string
 }
@@ -58,24 +71,18 @@ func recoveryHandler(outputErr bool, next http.Handler) http.Handler {
 	})
 }
 
-// filePathMiddleware is a middleware that converts URL path to physical file path, then stores the file path into context
-func filePathMiddleware(fileDir, pathPrefix string, next http.Handler) http.Handler {
-	if len(fileDir) <= 0 {
-		panic("fileDir should not be empty")
-	}
+// filePathMiddleware is a middleware that converts URL path to storage file name, then stores the file name into context
+//
+// If URL path is malformed, it will response http.StatusBadRequest. If URL path is reserved, it will response http.StatusForbidden
+func filePathMiddleware(pathPrefix string, next http.Handler) http.Handler {
 	return http.StripPrefix(pathPrefix, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if strings.HasPrefix(fileDir, "./") {
-			baseDir, err := os.Getwd()
-			if err != nil {
-				panic(err)
-			}
-			fileDir = filepath.Join(baseDir, strings.TrimPrefix(fileDir, "./"))
-		}
-		fileName := filepath.Join(fileDir, "/", req.URL.Path)
-		if u := req.URL.Path; !strings.HasSuffix(u, "/") && len(u) > 0 {
-			fileName += ".txt"
-		} else if !strings.HasSuffix(fileName, "/") {
-			fileName += "/"
+		fileName, err := resolveName(req.URL.Path)
+		if err == errForbiddenPath {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, reserved path"})
+			return
+		} else if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid path"})
+			return
 		}
 
 		ctx := context.WithValue(req.Context(), keyFileName, fileName)
@@ -84,23 +91,82 @@ func filePathMiddleware(fileDir, pathPrefix string, next http.Handler) http.Hand
 	}))
 }
 
-// jsonMiddleware is a middleware that tests request content-type should be application/json; charset=utf-8. If test failed, it will return http.StatusUnsupportedMediaType
-func jsonMiddleware(next http.Handler) http.Handler {
+// limitedBody is a io.ReadCloser that returns errBodyTooLarge when the body is larger than n bytes
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Probe one more byte to tell io.EOF from too large body
+		var b [1]byte
+		n, err := l.ReadCloser.Read(b[:])
+		if n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// utf8Reader is a io.Reader that returns errInvalidText when the content read is not valid UTF-8
+type utf8Reader struct {
+	r       io.Reader
+	pending []byte
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	data := append(u.pending, p[:n]...)
+
+	// An incomplete rune at the end is checked with the next read
+	valid := len(data)
+	if err != io.EOF {
+		for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+			if utf8.RuneStart(data[len(data)-i]) {
+				if !utf8.FullRune(data[len(data)-i:]) {
+					valid = len(data) - i
+				}
+				break
+			}
+		}
+	}
+	if !utf8.Valid(data[:valid]) {
+		return 0, errInvalidText
+	}
+	u.pending = append([]byte(nil), data[valid:]...)
+	return n, err
+}
+
+// limitBodyMiddleware is a middleware that limits request body size. If request body is larger than maxBodySize, it will return http.StatusRequestEntityTooLarge
+//
+// When size is unknown before reading, reading the body returns errBodyTooLarge. Zero maxBodySize means unlimited
+func limitBodyMiddleware(maxBodySize int64, next http.Handler) http.Handler {
+	if maxBodySize <= 0 {
+		return next
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		pass := true
-		contentType := req.Header.Get("CONTENT-TYPE")
-		mediaType, params, err := mime.ParseMediaType(contentType)
-		if err != nil {
-			pass = false
-		} else if mediaType != "application/json" {
-			pass = false
-		} else if charset, exist := params["charset"]; !exist {
-			pass = false
-		} else if charset != "utf-8" {
-			pass = false
+		if req.ContentLength > maxBodySize {
+			ren.JSON(w, http.StatusRequestEntityTooLarge, responseError{"Request body too large"})
+			return
+		}
+		if req.Body != nil {
+			req.Body = &limitedBody{req.Body, maxBodySize}
 		}
+		next.ServeHTTP(w, req)
+	})
+}
 
-		if !pass {
+// jsonMiddleware is a middleware that tests request content-type should be application/json; charset=utf-8. If test failed, it will return http.StatusUnsupportedMediaType
+func jsonMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if mediaType, ok := requestMediaType(req); !ok || mediaType != "application/json" {
 			ren.JSON(w, http.StatusUnsupportedMediaType, responseError{"Bad request, invalid content-type"})
 			return
 		}
@@ -109,31 +175,84 @@ func jsonMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// contentMiddleware is a middleware that reads and parses body, then stores the content into context
+// contentMiddleware is a middleware that reads and parses body, then stores the content reader into context
+//
+// Body is the JSON envelope (application/json; charset=utf-8), raw text (text/plain) or raw bytes (application/octet-stream).
+// Raw body is not read here but streamed by the handler, reading raw text returns errInvalidText if it is not valid UTF-8.
+// If content-type is not supported, it will return http.StatusUnsupportedMediaType
 func contentMiddleware(next http.Handler) http.Handler {
-	return jsonMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if req.ContentLength <= 0 {
-			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, no content"})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mediaType, ok := requestMediaType(req)
+		if !ok {
+			ren.JSON(w, http.StatusUnsupportedMediaType, responseError{"Bad request, invalid content-type"})
 			return
 		}
 
-		decoder := json.NewDecoder(req.Body)
-		decoder.DisallowUnknownFields()
 		defer func() {
 			io.Copy(ioutil.Discard, req.Body)
 			req.Body.Close()
 		}()
 
-		c := contentBody{}
-		if err := decoder.Decode(&c); err != nil || len(c.Content) <= 0 {
-			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, json parse failed"})
+		// Size of chunked body is unknown, peek it
+		body := bufio.NewReader(req.Body)
+		if _, err := body.Peek(1); req.ContentLength == 0 || err == io.EOF {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, no content"})
+			return
+		} else if err == errBodyTooLarge {
+			ren.JSON(w, http.StatusRequestEntityTooLarge, responseError{"Request body too large"})
 			return
 		}
 
-		ctx := context.WithValue(req.Context(), keyContent, c.Content)
+		var content io.Reader
+		switch mediaType {
+		case "application/json":
+			decoder := json.NewDecoder(body)
+			decoder.DisallowUnknownFields()
+
+			c := contentBody{}
+			if err := decoder.Decode(&c); err == errBodyTooLarge {
+				ren.JSON(w, http.StatusRequestEntityTooLarge, responseError{"Request body too large"})
+				return
+			} else if err != nil || len(c.Content) <= 0 {
+				ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, json parse failed"})
+				return
+			}
+			content = strings.NewReader(c.Content)
+		case "text/plain":
+			content = &utf8Reader{r: body}
+		default:
+			content = body
+		}
+
+		ctx := context.WithValue(req.Context(), keyContent, content)
 		req = req.WithContext(ctx)
 		next.ServeHTTP(w, req)
-	}))
+	})
+}
+
+// putContent writes the content from Context() into the file, then returns the ETag of the content
+//
+// If the content is too large or invalid, it responses the error and returns false
+//
+// Note: Must pass filePathMiddleware and contentMiddleware
+func putContent(w http.ResponseWriter, req *http.Request, store Storage) (string, bool) {
+	ctx := req.Context()
+	fileName := ctx.Value(keyFileName).(string)
+	content := ctx.Value(keyContent).(io.Reader)
+
+	h := newETagHash()
+	err := store.Put(fileName, io.TeeReader(content, h))
+	switch err {
+	case nil:
+		return hashETag(h), true
+	case errBodyTooLarge:
+		ren.JSON(w, http.StatusRequestEntityTooLarge, responseError{"Request body too large"})
+	case errInvalidText:
+		ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid utf-8 text"})
+	default:
+		panic(err)
+	}
+	return "", false
 }
 
 // fileExistsMiddleware is a middleware that check file exists at certain path, the path is from Context()
@@ -141,12 +260,18 @@ func contentMiddleware(next http.Handler) http.Handler {
 // If file does not exist, it will response http.StatusNotFound
 //
 // Note: Must pass filePathMiddleware
-func fileExistsMiddleware(next http.Handler) http.Handler {
+func fileExistsMiddleware(store Storage, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		fileName := req.Context().Value(keyFileName).(string)
 
+		fileInfo, err := store.Stat(fileName)
+		if isForbiddenPath(err) {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, path is outside of root"})
+			return
+		}
+
 		ok := false
-		if fileInfo, err := os.Stat(fileName); err == nil {
+		if err == nil {
 			ok = !fileInfo.IsDir()
 		}
 
@@ -164,12 +289,18 @@ func fileExistsMiddleware(next http.Handler) http.Handler {
 // If file does exist, it will response http.StatusForbidden
 //
 // Note: Must pass filePathMiddleware
-func fileNotExistsMiddleware(next http.Handler) http.Handler {
+func fileNotExistsMiddleware(store Storage, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		fileName := req.Context().Value(keyFileName).(string)
 
+		_, err := store.Stat(fileName)
+		if isForbiddenPath(err) {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, path is outside of root"})
+			return
+		}
+
 		ok := false
-		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		if os.IsNotExist(err) {
 			ok = true
 		}
 
@@ -187,17 +318,22 @@ func fileNotExistsMiddleware(next http.Handler) http.Handler {
 // If file does not exist, it will response http.StatusNotFound
 //
 // Note: Must pass filePathMiddleware
-func folderExistsMiddleware(next http.Handler) http.Handler {
+func folderExistsMiddleware(store Storage, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		fileName := req.Context().Value(keyFileName).(string)
 
+		fileInfo, err := store.Stat(fileName)
+		if isForbiddenPath(err) {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, path is outside of root"})
+			return
+		}
+
 		ok := false
-		if fileInfo, err := os.Stat(fileName); err == nil {
+		if err == nil {
 			ok = fileInfo.IsDir()
 		}
 
 		if !ok {
-			print(fileName)
 			ren.JSON(w, http.StatusNotFound, responseError{"Folder does not exist"})
 			return
 		}
@@ -206,91 +342,974 @@ func folderExistsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// createFileHandler is a handler that create a file from request
-func createFileHandler(fileDir, pathPrefix string) http.Handler {
-	return filePathMiddleware(fileDir, pathPrefix, fileNotExistsMiddleware(contentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		ctx := req.Context()
-		fileName := ctx.Value(keyFileName).(string)
-		dirName := filepath.Dir(fileName)
-		content := ctx.Value(keyContent).(string)
+// lockMiddleware is a middleware that locks the file exclusively until next handler returns, the path is from Context()
+//
+// Existence checks after it are made under the same lock as the mutation
+//
+// Note: Must pass filePathMiddleware
+func lockMiddleware(locks *pathLocker, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fileName := req.Context().Value(keyFileName).(string)
+
+		unlock := locks.Lock(fileName)
+		defer unlock()
+
+		next.ServeHTTP(w, req)
+	})
+}
 
-		if err := os.MkdirAll(dirName, os.ModePerm); err != nil {
+// createFileHandler is a handler that create a file from request, revisions left at the path (e.g. by a file removed outside of the service) are removed
+func createFileHandler(store Storage, locks *pathLocker, pathPrefix string) http.Handler {
+	return filePathMiddleware(pathPrefix, lockMiddleware(locks, fileNotExistsMiddleware(store, contentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := deleteRevisions(store, req.Context().Value(keyFileName).(string)); err != nil {
 			panic(err)
 		}
 
-		file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, os.ModePerm)
-		if err != nil {
-			panic(err)
+		etag, ok := putContent(w, req, store)
+		if !ok {
+			return
 		}
-		defer file.Close()
-		if _, err := file.Write(([]byte)(content)); err != nil {
-			panic(err)
+
+		// TODO: Log and send operator ID
+		w.Header().Set("ETag", etag)
+		ren.JSON(w, http.StatusOK, "Done")
+	})))))
+}
+
+// modifyFileHandler is a handler that update the file from request, the prior content is kept as a revision unless versions is nil
+//
+// If If-Match header is set and does not match, it will response http.StatusPreconditionFailed
+func modifyFileHandler(store Storage, locks *pathLocker, pathPrefix string, versions *versionPolicy) http.Handler {
+	return filePathMiddleware(pathPrefix, lockMiddleware(locks, fileExistsMiddleware(store, ifMatchMiddleware(store, contentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fileName := req.Context().Value(keyFileName).(string)
+
+		etag := ""
+		if !keepRevision(store, versions, fileName, operatorID(req), func() (ok bool) {
+			etag, ok = putContent(w, req, store)
+			return ok
+		}) {
+			return
 		}
 
 		// TODO: Log and send operator ID
+		w.Header().Set("ETag", etag)
 		ren.JSON(w, http.StatusOK, "Done")
-	}))))
+	}))))))
+}
+
+// keepRevision calls modify, which returns whether the named file is modified, and keeps the prior content as a revision unless versions is nil
+//
+// The revision is saved before modify is called, and removed if the file is not modified. Otherwise revisions are pruned by the policy
+func keepRevision(store Storage, versions *versionPolicy, name, operator string, modify func() bool) bool {
+	if versions == nil {
+		return modify()
+	}
+
+	rev, err := saveRevision(store, name, operator)
+	if err != nil {
+		panic(err)
+	}
+	if !modify() {
+		if err := deleteRevision(store, name, rev); err != nil {
+			panic(err)
+		}
+		return false
+	}
+	if _, err := pruneRevisions(store, name, versions, time.Now()); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// patchMiddleware is a middleware that reads and validates the patch in body, then stores the patch into context
+//
+// Note: Must pass jsonMiddleware
+func patchMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+
+		b := patchBody{}
+		if err := decoder.Decode(&b); err == errBodyTooLarge {
+			ren.JSON(w, http.StatusRequestEntityTooLarge, responseError{"Request body too large"})
+			return
+		} else if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, json parse failed"})
+			return
+		}
+
+		p, err := newPatch(&b)
+		if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, " + err.Error()})
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), keyPatch, p)
+		req = req.WithContext(ctx)
+		next.ServeHTTP(w, req)
+	})
 }
 
-// modifyFileHandler is a handler that update the file from request
-func modifyFileHandler(fileDir, pathPrefix string) http.Handler {
-	return filePathMiddleware(fileDir, pathPrefix, fileExistsMiddleware(contentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+// patchFileHandler applies the patch to the file, the patched content replaces the file atomically and the prior content is kept as a revision unless versions is nil
+//
+// If the patch does not apply to the current content, it will response http.StatusConflict and the file is unchanged
+func patchFileHandler(store Storage, locks *pathLocker, pathPrefix string, versions *versionPolicy) http.Handler {
+	return filePathMiddleware(pathPrefix, lockMiddleware(locks, fileExistsMiddleware(store, ifMatchMiddleware(store, jsonMiddleware(patchMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 		fileName := ctx.Value(keyFileName).(string)
-		content := ctx.Value(keyContent).(string)
+		p := ctx.Value(keyPatch).(*patch)
 
-		file, err := os.OpenFile(fileName, os.O_TRUNC|os.O_WRONLY, os.ModePerm)
-		if err != nil {
-			panic(err)
+		h := newETagHash()
+		if !keepRevision(store, versions, fileName, operatorID(req), func() bool {
+			file, err := store.Get(fileName)
+			if err != nil {
+				panic(err)
+			}
+			defer file.Close()
+
+			// Patched content is streamed into Put, a failed patch fails the Put and keeps the file unchanged
+			pr, pw := io.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				err := p.apply(pw, file)
+				pw.CloseWithError(err)
+				done <- err
+			}()
+
+			err = store.Put(fileName, io.TeeReader(pr, h))
+			pr.Close()
+			patchErr := <-done
+			if err != nil {
+				if patchErr == errPatchConflict {
+					ren.JSON(w, http.StatusConflict, responseError{"Conflict, patch does not apply"})
+					return false
+				}
+				panic(err)
+			}
+			return true
+		}) {
+			return
 		}
-		defer file.Close()
-		if _, err := file.Write(([]byte)(content)); err != nil {
+
+		w.Header().Set("ETag", hashETag(h))
+		ren.JSON(w, http.StatusOK, "Done")
+	})))))))
+}
+
+// removeFileHandler is a handler that remove the file, the file is moved to trash if useTrash is true
+//
+// If If-Match header is set and does not match, it will response http.StatusPreconditionFailed
+func removeFileHandler(store Storage, locks *pathLocker, pathPrefix string, useTrash bool) http.Handler {
+	return filePathMiddleware(pathPrefix, pruneMiddleware(store, locks, lockMiddleware(locks, fileExistsMiddleware(store, ifMatchMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fileName := req.Context().Value(keyFileName).(string)
+
+		if err := deleteFileFunc(store, useTrash, operatorID(req))(fileName); err != nil {
 			panic(err)
 		}
 
 		// TODO: Log and send operator ID
 		ren.JSON(w, http.StatusOK, "Done")
-	}))))
+	}))))))
 }
 
-// removeFileHandler is a handler that remove the file
-func removeFileHandler(fileDir, pathPrefix string) http.Handler {
-	return filePathMiddleware(fileDir, pathPrefix, fileExistsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+// deleteFileFunc returns the function deleting files, which moves text files to trash if useTrash is true, or removes their revisions as well
+func deleteFileFunc(store Storage, useTrash bool, operator string) func(string) error {
+	return func(name string) error {
+		if !useTrash || !strings.HasSuffix(name, ".txt") {
+			if err := store.Delete(name); err != nil {
+				return err
+			}
+			return deleteRevisions(store, name)
+		}
+		_, err := trashFile(store, name, operator)
+		return err
+	}
+}
+
+// operatorID returns the ID of the operator sending the request, which is the common name of client certificate, or X-Operator request header
+func operatorID(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return req.Header.Get("X-Operator")
+}
+
+// removal is the response of removing a folder, Removed are paths of files and folders removed, or would be removed if DryRun
+type removal struct {
+	DryRun  bool
+	Removed []string
+}
+
+// removeFolderHandler is a handler that removes the folder, text files under it are moved to trash if useTrash is true
+//
+// If folder is not empty, it will response http.StatusConflict, unless recursive query is true.
+// If dry-run query is true, it responses what would be removed without removing
+func removeFolderHandler(store Storage, locks *pathLocker, pathPrefix string, useTrash bool) http.Handler {
+	return filePathMiddleware(pathPrefix, pruneMiddleware(store, locks, lockMiddleware(locks, folderExistsMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dirname := req.Context().Value(keyFileName).(string)
+		if dirname == "/" {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, root folder can not be removed"})
+			return
+		}
+
+		recursive, err := queryBool(req, "recursive")
+		if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid recursive"})
+			return
+		}
+		dryRun, err := queryBool(req, "dry-run")
+		if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid dry-run"})
+			return
+		}
+
+		if !recursive {
+			files, err := store.List(dirname)
+			if err != nil {
+				panic(err)
+			}
+			if len(files) > 0 {
+				ren.JSON(w, http.StatusConflict, responseError{"Conflict, folder is not empty"})
+				return
+			}
+		}
+
+		names, err := removeAll(store, dirname, dryRun, deleteFileFunc(store, useTrash, operatorID(req)))
+		if err != nil {
+			panic(err)
+		}
+		r := removal{DryRun: dryRun, Removed: make([]string, len(names))}
+		for i, name := range names {
+			r.Removed[i] = strings.TrimSuffix(name, ".txt")
+		}
+
+		ren.JSON(w, http.StatusOK, r)
+	})))))
+}
+
+// pruneMiddleware is a middleware that removes empty parent folders after next handler succeeds if prune query is true, the path is from Context()
+//
+// Note: Must pass filePathMiddleware, and should not pass lockMiddleware, since parent folders are locked exclusively
+func pruneMiddleware(store Storage, locks *pathLocker, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		prune, err := queryBool(req, "prune")
+		if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid prune"})
+			return
+		}
+
+		sw := &statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		if sw.code < 200 || sw.code >= 300 {
+			return
+		}
+
+		fileName := req.Context().Value(keyFileName).(string)
+		if dirs := parentFolders(fileName); prune && len(dirs) > 0 {
+			pruneFolders(store, locks, dirs[0])
+		}
+	})
+}
+
+// statusResponseWriter is a http.ResponseWriter that records the status code written
+type statusResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// queryBool returns the boolean query parameter, which is false if not set
+func queryBool(req *http.Request, name string) (bool, error) {
+	v := req.URL.Query().Get(name)
+	if len(v) <= 0 {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// retrieveFileHandler is a handler that inspect the file content, ETag and counts are from cache (nil to disable), so the file is only read once until it changes
+//
+// It responses ETag and Last-Modified headers. If If-None-Match or If-Modified-Since header matches, it will response http.StatusNotModified.
+// HEAD does not read the content, Content-Length is absent unless the content is raw and whole
+func retrieveFileHandler(store Storage, locks *pathLocker, cache *statCache, pathPrefix string) http.Handler {
+	return filePathMiddleware(pathPrefix, fileExistsMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		fileName := req.Context().Value(keyFileName).(string)
 
-		if err := os.Remove(fileName); err != nil {
+		// Writers are excluded until the file is opened, so validators and counts are of the content served
+		unlock := locks.RLock(fileName)
+		file, stat, info, err := openFileStat(store, cache, fileName)
+		unlock()
+		if os.IsNotExist(err) {
+			// Removed after checked
+			ren.JSON(w, http.StatusNotFound, responseError{"File does not exist"})
+			return
+		} else if err != nil {
 			panic(err)
 		}
+		defer file.Close()
 
-		// TODO: Log and send operator ID
-		ren.JSON(w, http.StatusOK, "Done")
+		etag := stat.etag
+		setValidators(w, etag, info.ModTime())
+		w.Header().Set("X-Word-Count", strconv.Itoa(stat.wordLens.n))
+		w.Header().Set("X-Line-Count", strconv.Itoa(stat.lines))
+		w.Header().Set("Vary", "Accept")
+		if notModified(req, etag, info.ModTime()) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		mediaType, contentType, ok := negotiateContent(w, req)
+		if !ok {
+			return
+		}
+
+		lines, ranged := req.URL.Query()["lines"]
+		lr := lineRange{}
+		if ranged {
+			if lr, err = parseLineRange(lines[0]); err != nil {
+				ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid lines"})
+				return
+			}
+		}
+
+		// HEAD does not read the content, except raw content served by ServeContent, which only seeks the end
+		if req.Method == http.MethodHead && (ranged || mediaType == "application/json") {
+			if ranged && lr.first > stat.lines {
+				ren.JSON(w, http.StatusRequestedRangeNotSatisfiable, responseError{"Requested lines not satisfiable"})
+				return
+			}
+			if mediaType == "application/json" {
+				// The same as ren.JSON
+				contentType = render.ContentJSON + "; charset=UTF-8"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if ranged {
+			if mediaType == "application/json" {
+				b := bytes.Buffer{}
+				if err := copyLines(&b, file, lr); err == io.EOF {
+					ren.JSON(w, http.StatusRequestedRangeNotSatisfiable, responseError{"Requested lines not satisfiable"})
+				} else if err != nil {
+					panic(err)
+				} else {
+					ren.JSON(w, http.StatusOK, contentBody{b.String()})
+				}
+				return
+			}
+
+			// Nothing is written before the first line is found, so the error can still be responded
+			w.Header().Set("Content-Type", contentType)
+			if err := copyLines(w, file, lr); err == io.EOF {
+				ren.JSON(w, http.StatusRequestedRangeNotSatisfiable, responseError{"Requested lines not satisfiable"})
+			}
+			// Other errors are from the client connection, nothing can be done after header is written
+			return
+		}
+
+		if mediaType == "application/json" {
+			b, err := ioutil.ReadAll(file)
+			if err != nil {
+				panic(err)
+			}
+			ren.JSON(w, http.StatusOK, contentBody{
+				string(b),
+			})
+			return
+		}
+
+		// Range and If-Range are handled by ServeContent, validators are already set in header
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, req, "", info.ModTime(), file)
 	})))
 }
 
-// retrieveFileHandler is a handler that inspect the file content
-func retrieveFileHandler(fileDir, pathPrefix string) http.Handler {
-	return filePathMiddleware(fileDir, pathPrefix, fileExistsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+// fileStatsHandler is a handler that get some statistics of the file
+//
+// It responses ETag and Last-Modified headers. If If-None-Match or If-Modified-Since header matches, it will response http.StatusNotModified
+func fileStatsHandler(store Storage, pathPrefix string) http.Handler {
+	return filePathMiddleware(pathPrefix, fileExistsMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		fileName := req.Context().Value(keyFileName).(string)
 
-		b, err := ioutil.ReadFile(fileName)
+		info, err := store.Stat(fileName)
+		if err != nil {
+			panic(err)
+		}
+		file, err := store.Get(fileName)
 		if err != nil {
 			panic(err)
 		}
+		defer file.Close()
 
-		ren.JSON(w, http.StatusOK, contentBody{
-			string(b),
-		})
+		h := newETagHash()
+		stat := readFileStatistics(io.TeeReader(file, h), info.Size())
+
+		etag := hashETag(h)
+		setValidators(w, etag, info.ModTime())
+		if notModified(req, etag, info.ModTime()) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		ren.JSON(w, http.StatusOK, stat)
 	})))
 }
 
-// dirHandler is a handler that get some statistics per folder
-func dirHandler(fileDir, pathPrefix string) http.Handler {
-	return filePathMiddleware(fileDir, pathPrefix, folderExistsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+// negotiateContent returns the media type and content type of file content by Accept request header
+//
+// If no content type is acceptable, it responses http.StatusNotAcceptable and returns false
+func negotiateContent(w http.ResponseWriter, req *http.Request) (string, string, bool) {
+	mediaType := negotiate(req.Header.Get("Accept"), contentMediaTypes)
+	contentType := map[string]string{
+		"application/json":         jsonContentType,
+		"text/plain":               textContentType,
+		"application/octet-stream": binaryContentType,
+	}[mediaType]
+	if len(contentType) <= 0 {
+		ren.JSON(w, http.StatusNotAcceptable, responseError{"Not acceptable, supports application/json, text/plain and application/octet-stream"})
+		return "", "", false
+	}
+	return mediaType, contentType, true
+}
+
+// dirHandler is a handler that get some statistics per folder, files cached by cache are not read, others are read by workers in parallel
+//
+// If recursive query is true, statistics cover the subtree down to depth query levels (unlimited if absent), with statistics per sub folder.
+// If extended query is true, distributions and histograms are included as Extended. It stops reading files when the client disconnects
+func dirHandler(store Storage, cache *statCache, pathPrefix string, workers int) http.Handler {
+	return filePathMiddleware(pathPrefix, folderExistsMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		dirname := req.Context().Value(keyFileName).(string)
-		stat, err := dirStatistics(dirname)
+
+		recursive, err := queryBool(req, "recursive")
 		if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid recursive"})
+			return
+		}
+		o := &statOptions{workers: workers}
+		if recursive {
+			o.depth = -1
+			if v := req.URL.Query().Get("depth"); len(v) > 0 {
+				if o.depth, err = strconv.Atoi(v); err != nil || o.depth < 1 {
+					ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid depth"})
+					return
+				}
+			}
+		}
+		if o.extended, err = queryBool(req, "extended"); err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid extended"})
+			return
+		}
+
+		stat, err := dirStatistics(req.Context(), store, cache, dirname, o)
+		if err != nil && req.Context().Err() != nil {
+			// The client is gone, nothing to response
+			return
+		} else if err != nil {
 			panic(err)
 		}
 		ren.JSON(w, http.StatusOK, stat)
 	})))
 }
+
+// listHandler is a handler that lists files and folders in the folder, ETags of files are from cache (nil to disable)
+func listHandler(store Storage, cache *statCache, pathPrefix string) http.Handler {
+	return filePathMiddleware(pathPrefix, folderExistsMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dirname := req.Context().Value(keyFileName).(string)
+		o, err := parseListOptions(req)
+		if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, " + err.Error()})
+			return
+		}
+		l, err := listFolder(store, cache, dirname, o)
+		if err != nil {
+			panic(err)
+		}
+		ren.JSON(w, http.StatusOK, l)
+	})))
+}
+
+// headResponseWriter is a http.ResponseWriter that discards body, and holds the header until flush
+type headResponseWriter struct {
+	http.ResponseWriter
+	code int
+	size int64
+}
+
+func (w *headResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *headResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// flush writes the header, Content-Length is the size of body discarded if it is not set, and absent if nothing is discarded
+// (e.g. the handler skips the body of HEAD)
+func (w *headResponseWriter) flush() {
+	w.WriteHeader(http.StatusOK)
+	if len(w.Header().Get("Content-Length")) <= 0 && w.size > 0 && w.code != http.StatusNotModified && w.code != http.StatusNoContent {
+		w.Header().Set("Content-Length", strconv.FormatInt(w.size, 10))
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+// headMiddleware is a middleware that responses the header of next handler only, so HEAD responses the same header as GET
+func headMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hw := &headResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(hw, req)
+		hw.flush()
+	})
+}
+
+// optionsHandler is a handler that responses methods allowed on the file or folder in Allow header
+//
+// If folder does not exist, it will response http.StatusNotFound
+func optionsHandler(store Storage, pathPrefix string) http.Handler {
+	return filePathMiddleware(pathPrefix, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fileName := req.Context().Value(keyFileName).(string)
+		info, err := store.Stat(fileName)
+		exists := err == nil
+		if isForbiddenPath(err) {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, path is outside of root"})
+			return
+		} else if err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+
+		methods := []string{}
+		switch {
+		case fileName == "/":
+			methods = []string{http.MethodGet, http.MethodHead}
+		case strings.HasSuffix(fileName, "/") && exists && info.IsDir():
+			methods = []string{http.MethodGet, http.MethodHead, http.MethodDelete, "MOVE", "COPY"}
+		case strings.HasSuffix(fileName, "/"):
+			ren.JSON(w, http.StatusNotFound, responseError{"Folder does not exist"})
+			return
+		case exists && !info.IsDir():
+			methods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete, "MOVE", "COPY"}
+		case !exists:
+			methods = []string{http.MethodPost}
+		}
+
+		w.Header().Set("Allow", strings.Join(append(methods, http.MethodOptions), ", "))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// destinationMiddleware is a middleware that reads the destination from Destination request header (URL or path), then stores the destination into context
+//
+// Destination should be the same kind (file or folder) as the source, and not inside each other.
+// If Destination is same as the source, it will response http.StatusForbidden
+//
+// Note: Must pass filePathMiddleware
+func destinationMiddleware(pathPrefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fileName := req.Context().Value(keyFileName).(string)
+
+		u, err := url.Parse(req.Header.Get("Destination"))
+		if err != nil || len(u.Path) <= 0 || !strings.HasPrefix(u.Path, pathPrefix) {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid destination"})
+			return
+		}
+		destName, err := resolveName(strings.TrimPrefix(u.Path, pathPrefix))
+		if err == errForbiddenPath {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, reserved destination"})
+			return
+		} else if err != nil {
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid destination"})
+			return
+		}
+
+		switch {
+		case destName == fileName:
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, destination is same as source"})
+			return
+		case strings.HasSuffix(destName, "/") != strings.HasSuffix(fileName, "/"):
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, destination should be same kind as source"})
+			return
+		case strings.HasSuffix(fileName, "/") && (strings.HasPrefix(destName, fileName) || strings.HasPrefix(fileName, destName)):
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, destination and source are inside each other"})
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), keyDestination, destName)
+		req = req.WithContext(ctx)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// transferHandler is a handler that moves or copies the file or folder to the destination, like WebDAV MOVE and COPY
+//
+// Destination is replaced unless Overwrite request header is "F", text files replaced are moved to trash if useTrash is true, like DELETE.
+// Without trash, files are moved atomically. It responses http.StatusCreated if the destination is created, or http.StatusNoContent if replaced
+func transferHandler(store Storage, locks *pathLocker, pathPrefix string, move, useTrash bool) http.Handler {
+	return filePathMiddleware(pathPrefix, destinationMiddleware(pathPrefix, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		fileName := ctx.Value(keyFileName).(string)
+		destName := ctx.Value(keyDestination).(string)
+		isDir := strings.HasSuffix(fileName, "/")
+
+		overwrite := true
+		switch strings.ToUpper(req.Header.Get("Overwrite")) {
+		case "", "T":
+		case "F":
+			overwrite = false
+		default:
+			ren.JSON(w, http.StatusBadRequest, responseError{"Bad request, invalid overwrite"})
+			return
+		}
+
+		unlock := locks.Lock(fileName, destName)
+		defer unlock()
+
+		info, err := store.Stat(fileName)
+		if isForbiddenPath(err) {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, path is outside of root"})
+			return
+		} else if err != nil || info.IsDir() != isDir {
+			ren.JSON(w, http.StatusNotFound, responseError{"File does not exist"})
+			return
+		}
+		if !isDir && !checkIfMatch(w, req, store, fileName) {
+			return
+		}
+
+		// Destination and its parent folders should be the expected kinds
+		destInfo, err := store.Stat(destName)
+		exists := err == nil
+		if isForbiddenPath(err) {
+			ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, destination is outside of root"})
+			return
+		} else if exists && destInfo.IsDir() != isDir {
+			ren.JSON(w, http.StatusConflict, responseError{"Conflict, destination is different kind"})
+			return
+		} else if exists && !overwrite {
+			ren.JSON(w, http.StatusPreconditionFailed, responseError{"Precondition failed, destination exists"})
+			return
+		}
+		for _, dir := range parentFolders(destName) {
+			if info, err := store.Stat(dir); err == nil && !info.IsDir() {
+				ren.JSON(w, http.StatusConflict, responseError{"Conflict, parent of destination is a file"})
+				return
+			}
+		}
+
+		// Folders are merged, so remove the destination folder first. Files are replaced atomically, unless they are moved to trash first
+		if exists && (isDir || useTrash) {
+			if _, err := removeAll(store, destName, false, deleteFileFunc(store, useTrash, operatorID(req))); err != nil {
+				panic(err)
+			}
+		}
+		// Revisions move along with files, copies start without revisions
+		if move {
+			err = store.Move(fileName, destName)
+			if err == nil {
+				err = moveRevisions(store, fileName, destName)
+			}
+		} else {
+			err = deleteRevisions(store, destName)
+			if err == nil {
+				err = copyAll(store, fileName, destName)
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		ren.JSON(w, http.StatusCreated, "Done")
+	})))
+}
+
+// listTrashHandler is a handler that lists items in trash, latest deleted first
+//
+// If path query is set (e.g. "/news/"), only items originally under it are listed
+func listTrashHandler(store Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dirname := req.URL.Query().Get("path")
+		if len(dirname) <= 0 {
+			dirname = "/"
+		}
+		items, err := listTrash(store, dirname)
+		if err != nil {
+			panic(err)
+		}
+		ren.JSON(w, http.StatusOK, items)
+	})
+}
+
+// trashItemHandler is a handler that gets the item in trash, the ID is from route variable "id"
+func trashItemHandler(store Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		item, err := getTrashItem(store, mux.Vars(req)["id"])
+		if os.IsNotExist(err) {
+			ren.JSON(w, http.StatusNotFound, responseError{"Item does not exist"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		ren.JSON(w, http.StatusOK, item)
+	})
+}
+
+// purgeTrashHandler is a handler that removes the item in trash permanently, or every item if route variable "id" is not set
+func purgeTrashHandler(store Storage, locks *pathLocker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, ok := mux.Vars(req)["id"]
+		if !ok {
+			unlock := locks.Lock(trashFolder)
+			defer unlock()
+
+			n, err := purgeTrash(store)
+			if err != nil {
+				panic(err)
+			}
+			ren.JSON(w, http.StatusOK, fmt.Sprintf("%d items purged", n))
+			return
+		}
+
+		unlock := locks.Lock(trashFolder + id + ".txt")
+		defer unlock()
+
+		item, err := getTrashItem(store, id)
+		if os.IsNotExist(err) {
+			ren.JSON(w, http.StatusNotFound, responseError{"Item does not exist"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		if err := purgeTrashItem(store, item); err != nil {
+			panic(err)
+		}
+
+		ren.JSON(w, http.StatusOK, "Done")
+	})
+}
+
+// restoreTrashHandler is a handler that moves the item in trash back to its original path, the ID is from route variable "id"
+//
+// If a file exists at the original path, it will response http.StatusConflict
+func restoreTrashHandler(store Storage, locks *pathLocker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := mux.Vars(req)["id"]
+		contentName := trashFolder + id + ".txt"
+
+		// The original path is unknown until the item is read, it is read again after both names are locked at once,
+		// since nested locks of names share parent folders, which deadlocks with a writer of the parent folder waiting between them
+		item, err := getTrashItem(store, id)
+		if os.IsNotExist(err) {
+			ren.JSON(w, http.StatusNotFound, responseError{"Item does not exist"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+
+		fileName := item.Path + ".txt"
+		unlock := locks.Lock(contentName, fileName)
+		defer unlock()
+
+		// Restored or purged after read
+		if item, err = getTrashItem(store, id); os.IsNotExist(err) {
+			ren.JSON(w, http.StatusNotFound, responseError{"Item does not exist"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+
+		if _, err := store.Stat(fileName); err == nil {
+			ren.JSON(w, http.StatusConflict, responseError{"Conflict, file does exist"})
+			return
+		} else if !os.IsNotExist(err) {
+			panic(err)
+		}
+		for _, dir := range parentFolders(fileName) {
+			if info, err := store.Stat(dir); err == nil && !info.IsDir() {
+				ren.JSON(w, http.StatusConflict, responseError{"Conflict, parent of file is a file"})
+				return
+			}
+		}
+		if err := restoreTrashItem(store, item, fileName); os.IsNotExist(err) {
+			ren.JSON(w, http.StatusNotFound, responseError{"Item does not exist"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+
+		ren.JSON(w, http.StatusOK, "Done")
+	})
+}
+
+// versionsHandler is a handler that inspects revisions of the file
+//
+// Query versions lists revisions latest first, version=<ID> responses the content of revision,
+// and diff=<ID> responses the unified diff from the revision to the revision of to=<ID> query, or the current content if to is absent or "current".
+// The content of revision is streamed with Range and Last-Modified unless JSON is accepted.
+// If the file does not exist, it will response http.StatusNotFound, even if revisions are left
+func versionsHandler(store Storage, locks *pathLocker, pathPrefix string) http.Handler {
+	return filePathMiddleware(pathPrefix, fileExistsMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fileName := req.Context().Value(keyFileName).(string)
+		q := req.URL.Query()
+
+		if _, ok := q["versions"]; ok {
+			revs, err := listRevisions(store, fileName)
+			if isForbiddenPath(err) {
+				ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, path is outside of root"})
+				return
+			} else if err != nil {
+				panic(err)
+			}
+			ren.JSON(w, http.StatusOK, revs)
+			return
+		}
+
+		// openContent opens the revision, or the current content if id is "current", modTime is the time the revision is replaced (zero for the current content)
+		openContent := func(id string) (f File, modTime time.Time, ok bool) {
+			// Writers are excluded until it is opened, so the revision found is not pruned or moved before its content is opened
+			unlock := locks.RLock(fileName)
+			defer unlock()
+
+			name := fileName
+			if id != "current" {
+				rev, err := getRevision(store, fileName, id)
+				if os.IsNotExist(err) {
+					ren.JSON(w, http.StatusNotFound, responseError{"Revision does not exist"})
+					return nil, time.Time{}, false
+				} else if err != nil {
+					panic(err)
+				}
+				name = rev.contentName(fileName)
+				modTime = rev.Time
+			}
+
+			f, err := store.Get(name)
+			if isForbiddenPath(err) {
+				ren.JSON(w, http.StatusForbidden, responseError{"Forbidden, path is outside of root"})
+				return nil, time.Time{}, false
+			} else if os.IsNotExist(err) {
+				ren.JSON(w, http.StatusNotFound, responseError{"File does not exist"})
+				return nil, time.Time{}, false
+			} else if err != nil {
+				panic(err)
+			}
+			return f, modTime, true
+		}
+		// readContent reads the revision, or the current content if id is "current"
+		readContent := func(id string) (string, bool) {
+			f, _, ok := openContent(id)
+			if !ok {
+				return "", false
+			}
+			defer f.Close()
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				panic(err)
+			}
+			return string(b), true
+		}
+
+		mediaType, contentType, ok := negotiateContent(w, req)
+		if !ok {
+			return
+		}
+		content := ""
+		if from := q.Get("diff"); len(from) > 0 {
+			to := q.Get("to")
+			if len(to) <= 0 {
+				to = "current"
+			}
+			a, ok := readContent(from)
+			if !ok {
+				return
+			}
+			b, ok := readContent(to)
+			if !ok {
+				return
+			}
+			buf := bytes.Buffer{}
+			urlPath := strings.TrimSuffix(fileName, ".txt")
+			if err := writeUnifiedDiff(&buf, urlPath+"@"+from, urlPath+"@"+to, a, b); err != nil {
+				panic(err)
+			}
+			content = buf.String()
+		} else if mediaType != "application/json" {
+			// The revision is streamed, which may be larger than memory
+			f, modTime, ok := openContent(q.Get("version"))
+			if !ok {
+				return
+			}
+			defer f.Close()
+			w.Header().Set("Content-Type", contentType)
+			http.ServeContent(w, req, "", modTime, f)
+			return
+		} else if content, ok = readContent(q.Get("version")); !ok {
+			return
+		}
+
+		if mediaType == "application/json" {
+			ren.JSON(w, http.StatusOK, contentBody{content})
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, content)
+	})))
+}
+
+// rollbackHandler is a handler that replaces the file with the revision of rollback=<ID> query, the replaced content is kept as a revision unless versions is nil
+//
+// If If-Match header is set and does not match, it will response http.StatusPreconditionFailed
+func rollbackHandler(store Storage, locks *pathLocker, pathPrefix string, versions *versionPolicy) http.Handler {
+	return filePathMiddleware(pathPrefix, lockMiddleware(locks, fileExistsMiddleware(store, ifMatchMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fileName := req.Context().Value(keyFileName).(string)
+
+		rev, err := getRevision(store, fileName, req.URL.Query().Get("rollback"))
+		if os.IsNotExist(err) {
+			ren.JSON(w, http.StatusNotFound, responseError{"Revision does not exist"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		f, err := store.Get(rev.contentName(fileName))
+		if os.IsNotExist(err) {
+			ren.JSON(w, http.StatusNotFound, responseError{"Revision does not exist"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+
+		h := newETagHash()
+		keepRevision(store, versions, fileName, operatorID(req), func() bool {
+			if err := store.Put(fileName, io.TeeReader(f, h)); err != nil {
+				panic(err)
+			}
+			return true
+		})
+
+		w.Header().Set("ETag", hashETag(h))
+		ren.JSON(w, http.StatusOK, "Done")
+	})))))
+}
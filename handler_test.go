@@ -4,22 +4,30 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 func TestFilePathMiddleware(t *testing.T) {
 	const notFoundResult = "404"
-	testFunc := func(fileDir, pathPrefix, requestURL, expectPath string) {
-		h := filePathMiddleware(fileDir, pathPrefix, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	testFunc := func(pathPrefix, requestURL, expectPath string) {
+		h := filePathMiddleware(pathPrefix, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			if expectPath != notFoundResult {
 				fpath := req.Context().Value(keyFileName).(string)
 				if fpath != expectPath {
-					t.Errorf("Wrong path, fileDir: %s, pathPrefix: %s, requestURL: %s, expectPath: %s, got: %s", fileDir, pathPrefix, requestURL, expectPath, fpath)
+					t.Errorf("Wrong path, pathPrefix: %s, requestURL: %s, expectPath: %s, got: %s", pathPrefix, requestURL, expectPath, fpath)
 				}
 			}
 		}))
@@ -34,20 +42,104 @@ func TestFilePathMiddleware(t *testing.T) {
 		}
 	}
 
-	testFunc("/", "/", "/", "/")
-	testFunc("/", "/", "/io", "/io.txt")
-	testFunc("/", "/", "/docs/io", "/docs/io.txt")
-	testFunc("/", "/", "/docs/io/", "/docs/io/")
-	testFunc("/files", "/api", "/api/io", "/files/io.txt")
-	testFunc("/files", "/api", "/api/io/", "/files/io/")
-	testFunc("/files", "/api", "/io", notFoundResult)
-	testFunc("/static", "/", "http://127.0.0.1", "/static/")
-	testFunc("/static", "/", "http://127.0.0.1/", "/static/")
-	testFunc("/static", "/", "http://127.0.0.1/io", "/static/io.txt")
-	testFunc("/static", "/", "http://127.0.0.1/io/", "/static/io/")
+	testFunc("/", "/", "/")
+	testFunc("/", "/io", "/io.txt")
+	testFunc("/", "/docs/io", "/docs/io.txt")
+	testFunc("/", "/docs/io/", "/docs/io/")
+	testFunc("/api", "/api/io", "/io.txt")
+	testFunc("/api", "/api/io/", "/io/")
+	testFunc("/api", "/io", notFoundResult)
+	testFunc("/", "http://127.0.0.1", "/")
+	testFunc("/", "http://127.0.0.1/", "/")
+	testFunc("/", "http://127.0.0.1/io", "/io.txt")
+	testFunc("/", "http://127.0.0.1/io/", "/io/")
+	testFunc("/api/v2", "/api/v2/io", "/io.txt")
+}
+
+func TestFilePathMiddlewareRejects(t *testing.T) {
+	tests := []struct {
+		requestURL string
+		expectCode int
+	}{
+		{"/io", http.StatusOK},
+		{"/docs/io/", http.StatusOK},
+		{"/%2e%2e/etc/passwd", http.StatusBadRequest},
+		{"/docs/%2e%2e/%2e%2e/etc/passwd", http.StatusBadRequest},
+		{"/docs/..%2f..%2fetc/passwd", http.StatusBadRequest},
+		{"/docs/%2e/io", http.StatusBadRequest},
+		{"/docs/io%00.png", http.StatusBadRequest},
+		{"/docs/io%0a", http.StatusBadRequest},
+		{"/docs/..%5c..%5cwindows", http.StatusBadRequest},
+		{"/c:%5cwindows", http.StatusBadRequest},
+		{"/.hidden", http.StatusForbidden},
+		{"/docs/.trash/io", http.StatusForbidden},
+		{"/docs/.git/", http.StatusForbidden},
+	}
 
-	baseDir, _ := os.Getwd()
-	testFunc("./files", "/api/v2", "/api/v2/io", filepath.Join(baseDir, "/files/io.txt"))
+	for _, test := range tests {
+		h := filePathMiddleware("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, test.requestURL, nil)
+		h.ServeHTTP(w, req)
+		if w.Code != test.expectCode {
+			t.Errorf("Unexpected code, requestURL: %s, want: %d, got: %d", test.requestURL, test.expectCode, w.Code)
+		}
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	tests := []struct {
+		urlPath   string
+		expect    string
+		expectErr error
+	}{
+		{"", "/", nil},
+		{"/", "/", nil},
+		{"io", "/io.txt", nil},
+		{"/io", "/io.txt", nil},
+		{"docs/io", "/docs/io.txt", nil},
+		{"docs/io/", "/docs/io/", nil},
+		{"docs//io", "/docs/io.txt", nil},
+		{"docs/io.v2", "/docs/io.v2.txt", nil},
+		{"docs/io..v2", "/docs/io..v2.txt", nil},
+		{"docs/io.", "/docs/io..txt", nil},
+		{"docs/...", "", errForbiddenPath},
+		{"日本/ニュース", "/日本/ニュース.txt", nil},
+		{"a b/c:d", "/a b/c:d.txt", nil},
+		{"..", "", errInvalidPath},
+		{"../", "", errInvalidPath},
+		{"/..", "", errInvalidPath},
+		{"docs/..", "", errInvalidPath},
+		{"docs/../io", "", errInvalidPath},
+		{"docs/../../etc/passwd", "", errInvalidPath},
+		{".", "", errInvalidPath},
+		{"./io", "", errInvalidPath},
+		{"docs/./io", "", errInvalidPath},
+		{"docs/io/.", "", errInvalidPath},
+		{"io\x00", "", errInvalidPath},
+		{"io\x00.txt", "", errInvalidPath},
+		{"io\n", "", errInvalidPath},
+		{"io\r", "", errInvalidPath},
+		{"io\t", "", errInvalidPath},
+		{"io\x7f", "", errInvalidPath},
+		{"..\\io", "", errInvalidPath},
+		{"docs\\..\\..\\io", "", errInvalidPath},
+		{"\\\\server\\share", "", errInvalidPath},
+		{".hidden", "", errForbiddenPath},
+		{".hidden/", "", errForbiddenPath},
+		{"docs/.hidden", "", errForbiddenPath},
+		{"docs/.trash/io", "", errForbiddenPath},
+		{".../io", "", errForbiddenPath},
+	}
+
+	for _, test := range tests {
+		name, err := resolveName(test.urlPath)
+		if err != test.expectErr {
+			t.Errorf("Unexpected error, urlPath: %q, want: %v, got: %v", test.urlPath, test.expectErr, err)
+		} else if err == nil && name != test.expect {
+			t.Errorf("Unexpected name, urlPath: %q, want: %s, got: %s", test.urlPath, test.expect, name)
+		}
+	}
 }
 
 func TestJsonMiddleware(t *testing.T) {
@@ -88,8 +180,8 @@ func TestContentMiddleware(t *testing.T) {
 		req.Header.Set("CONTENT-TYPE", "application/json; charset=utf-8")
 		w := httptest.NewRecorder()
 		h := contentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			readContent := req.Context().Value(keyContent).(string)
-			if len(expectContent) > 0 && readContent != expectContent {
+			readContent, err := ioutil.ReadAll(req.Context().Value(keyContent).(io.Reader))
+			if err != nil || len(expectContent) > 0 && string(readContent) != expectContent {
 				t.Fatalf("Read failed, content was not same")
 			}
 		}))
@@ -114,9 +206,48 @@ func TestContentMiddleware(t *testing.T) {
 	testFunc(&struct{}{}, http.StatusBadRequest)
 }
 
-func getFileName(fileDir, pathPrefix, pathName string) (string, error) {
+func TestLimitBodyMiddleware(t *testing.T) {
+	testFunc := func(maxBodySize int64, body string, expectCode int) {
+		b, _ := json.Marshal(contentBody{body})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+		req.Header.Set("CONTENT-TYPE", jsonContentType)
+		w := httptest.NewRecorder()
+		h := limitBodyMiddleware(maxBodySize, contentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		})))
+
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, maxBodySize: %d, body: %s, want: %d, got: %d", maxBodySize, body, expectCode, w.Code)
+		}
+	}
+
+	testFunc(0, "hello world", http.StatusOK)
+	testFunc(100, "hello world", http.StatusOK)
+	testFunc(25, "hello world", http.StatusOK)
+	testFunc(24, "hello world", http.StatusRequestEntityTooLarge)
+}
+
+func TestLimitedBody(t *testing.T) {
+	testFunc := func(n int64, data string, expectErr error) {
+		r := &limitedBody{ioutil.NopCloser(strings.NewReader(data)), n}
+		b, err := ioutil.ReadAll(r)
+		if err != expectErr {
+			t.Errorf("Unexpected error, n: %d, data: %s, want: %v, got: %v", n, data, expectErr, err)
+		} else if err == nil && string(b) != data {
+			t.Errorf("Unexpected data, want: %s, got: %s", data, b)
+		}
+	}
+
+	testFunc(5, "hello", nil)
+	testFunc(6, "hello", nil)
+	testFunc(4, "hello", errBodyTooLarge)
+	testFunc(0, "", nil)
+	testFunc(0, "h", errBodyTooLarge)
+}
+
+func getFileName(pathPrefix, pathName string) (string, error) {
 	fileName := ""
-	h := filePathMiddleware(fileDir, pathPrefix, (http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	h := filePathMiddleware(pathPrefix, (http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		fileName = req.Context().Value(keyFileName).(string)
 	})))
 	r := httptest.NewRequest(http.MethodPost, pathName, nil)
@@ -128,18 +259,27 @@ func getFileName(fileDir, pathPrefix, pathName string) (string, error) {
 	return fileName, nil
 }
 
+func readFile(store Storage, fileName string) ([]byte, error) {
+	f, err := store.Get(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
 func TestCreateFileHandler(t *testing.T) {
-	const fileDir = "./files"
 	const pathPrefix = "/"
 	const pathName = "/test"
 
-	fileName, err := getFileName(fileDir, pathPrefix, pathName)
+	fileName, err := getFileName(pathPrefix, pathName)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Create file
-	h := createFileHandler(fileDir, pathPrefix)
+	store := NewMemoryStorage()
+	h := createFileHandler(store, newPathLocker(), pathPrefix)
 	c := `Hello world, A test
 text with new line
 3456`
@@ -153,13 +293,10 @@ text with new line
 		t.Fatalf("Create failed, response body: %s, code: %d", w.Body.String(), w.Code)
 	}
 
-	// Remove file in the end
-	defer os.Remove(fileName)
-
-	if fileInfo, err := os.Stat(fileName); err == nil {
+	if fileInfo, err := store.Stat(fileName); err == nil {
 		if fileInfo.IsDir() {
 			t.Fatalf("Should be file, not folder, %s", fileName)
-		} else if b, err := ioutil.ReadFile(fileName); err != nil {
+		} else if b, err := readFile(store, fileName); err != nil {
 			t.Fatalf("Read file failed, %v", err)
 		} else if c != string(b) {
 			t.Fatalf("Write file failed, content is not same, %s", fileName)
@@ -180,18 +317,19 @@ text with new line
 }
 
 func TestModifyFileHandler(t *testing.T) {
-	const fileDir = "./files"
 	const pathPrefix = "/"
 	const pathName = "/test"
 
-	fileName, err := getFileName(fileDir, pathPrefix, pathName)
+	fileName, err := getFileName(pathPrefix, pathName)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	store := NewMemoryStorage()
+
 	// Modify file if file is not exsits
 	{
-		h := modifyFileHandler(fileDir, pathPrefix)
+		h := modifyFileHandler(store, newPathLocker(), pathPrefix, nil)
 		b, _ := json.Marshal(contentBody{`Hello world, A test
 		text with new line
 		3456`})
@@ -206,14 +344,13 @@ func TestModifyFileHandler(t *testing.T) {
 	}
 
 	// Create file
-	if err := ioutil.WriteFile(fileName, ([]byte)("hello"), os.ModePerm); err != nil {
+	if err := store.Put(fileName, strings.NewReader("hello")); err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(fileName)
 
 	// Modify file if file exsits
 	{
-		h := modifyFileHandler(fileDir, pathPrefix)
+		h := modifyFileHandler(store, newPathLocker(), pathPrefix, nil)
 		s := `Hello world, A test
 		text with new line
 		3456`
@@ -227,7 +364,7 @@ func TestModifyFileHandler(t *testing.T) {
 			t.Fatalf("Unexpected response, body: %s, code: %d", w.Body.String(), w.Code)
 		}
 
-		if c, err := ioutil.ReadFile(fileName); err != nil {
+		if c, err := readFile(store, fileName); err != nil {
 			t.Fatal(err)
 		} else if string(c) != s {
 			t.Errorf("File content is not same, want: %s, got: %s", s, string(c))
@@ -236,18 +373,19 @@ func TestModifyFileHandler(t *testing.T) {
 }
 
 func TestRemoveFileHandler(t *testing.T) {
-	const fileDir = "./files"
 	const pathPrefix = "/"
 	const pathName = "/test"
 
-	fileName, err := getFileName(fileDir, pathPrefix, pathName)
+	fileName, err := getFileName(pathPrefix, pathName)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	store := NewMemoryStorage()
+
 	// Remove file if file is not exsits
 	{
-		h := removeFileHandler(fileDir, pathPrefix)
+		h := removeFileHandler(store, newPathLocker(), pathPrefix, false)
 		r := httptest.NewRequest(http.MethodDelete, pathName, nil)
 		w := httptest.NewRecorder()
 		h.ServeHTTP(w, r)
@@ -258,14 +396,13 @@ func TestRemoveFileHandler(t *testing.T) {
 	}
 
 	// Create file
-	if err := ioutil.WriteFile(fileName, ([]byte)("hello"), os.ModePerm); err != nil {
+	if err := store.Put(fileName, strings.NewReader("hello")); err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(fileName)
 
 	// Remove file if file exsits
 	{
-		h := removeFileHandler(fileDir, pathPrefix)
+		h := removeFileHandler(store, newPathLocker(), pathPrefix, false)
 		r := httptest.NewRequest(http.MethodDelete, pathName, nil)
 		w := httptest.NewRecorder()
 		h.ServeHTTP(w, r)
@@ -274,25 +411,26 @@ func TestRemoveFileHandler(t *testing.T) {
 			t.Fatalf("Unexpected response, body: %s, code: %d", w.Body.String(), w.Code)
 		}
 
-		if _, err := os.Stat(fileName); err == nil || os.IsExist(err) {
+		if _, err := store.Stat(fileName); !os.IsNotExist(err) {
 			t.Errorf("File remove failed, %s", fileName)
 		}
 	}
 }
 
 func TestRetrieveFileHandler(t *testing.T) {
-	const fileDir = "./files"
 	const pathPrefix = "/"
 	const pathName = "/test"
 
-	fileName, err := getFileName(fileDir, pathPrefix, pathName)
+	fileName, err := getFileName(pathPrefix, pathName)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	store := NewMemoryStorage()
+
 	// Retrieve file if file is not exsits
 	{
-		h := retrieveFileHandler(fileDir, pathPrefix)
+		h := retrieveFileHandler(store, newPathLocker(), nil, pathPrefix)
 		r := httptest.NewRequest(http.MethodGet, pathName, nil)
 		w := httptest.NewRecorder()
 		h.ServeHTTP(w, r)
@@ -306,14 +444,13 @@ func TestRetrieveFileHandler(t *testing.T) {
 	data := `helloekmfvcx
 	dcmdiew
 	mv cx,m ie`
-	if err := ioutil.WriteFile(fileName, ([]byte)(data), os.ModePerm); err != nil {
+	if err := store.Put(fileName, strings.NewReader(data)); err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(fileName)
 
 	// Retrieve file if file exsits
 	{
-		h := retrieveFileHandler(fileDir, pathPrefix)
+		h := retrieveFileHandler(store, newPathLocker(), nil, pathPrefix)
 		r := httptest.NewRequest(http.MethodGet, pathName, nil)
 		w := httptest.NewRecorder()
 		h.ServeHTTP(w, r)
@@ -332,3 +469,1088 @@ func TestRetrieveFileHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestConditionalRequests(t *testing.T) {
+	store := NewMemoryStorage()
+	h := service(store, newPathLocker(), defaultConfig())
+
+	do := func(method, target, body string, header map[string]string, expectCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("CONTENT-TYPE", jsonContentType)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s %s, header: %v, want: %d, got: %d, body: %s", method, target, header, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	w := do(http.MethodPost, "/news/today", `{"Content":"hello"}`, nil, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	if etag != contentETag(([]byte)("hello")) {
+		t.Errorf("Unexpected ETag of created file, got: %s", etag)
+	}
+
+	w = do(http.MethodGet, "/news/today", "", nil, http.StatusOK)
+	if w.Header().Get("ETag") != etag {
+		t.Errorf("Unexpected ETag, want: %s, got: %s", etag, w.Header().Get("ETag"))
+	}
+	lastModified := w.Header().Get("Last-Modified")
+	if _, err := http.ParseTime(lastModified); err != nil {
+		t.Errorf("Unexpected Last-Modified, %s, %v", lastModified, err)
+	}
+
+	w = do(http.MethodGet, "/news/today", "", map[string]string{"If-None-Match": etag}, http.StatusNotModified)
+	if w.Body.Len() > 0 {
+		t.Errorf("Not modified response should not have body, got: %s", w.Body.String())
+	}
+	do(http.MethodGet, "/news/today", "", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified)
+	do(http.MethodGet, "/news/today", "", map[string]string{"If-None-Match": `"other"`}, http.StatusOK)
+
+	do(http.MethodPut, "/news/today", `{"Content":"mine"}`, map[string]string{"If-Match": `"other"`}, http.StatusPreconditionFailed)
+	w = do(http.MethodPut, "/news/today", `{"Content":"mine"}`, map[string]string{"If-Match": etag}, http.StatusOK)
+	newETag := w.Header().Get("ETag")
+	if newETag == etag || newETag != contentETag(([]byte)("mine")) {
+		t.Errorf("Unexpected ETag of modified file, got: %s", newETag)
+	}
+
+	// Stale ETag should not clobber the newer edit
+	do(http.MethodPut, "/news/today", `{"Content":"theirs"}`, map[string]string{"If-Match": etag}, http.StatusPreconditionFailed)
+	if b, _ := readFile(store, "/news/today.txt"); string(b) != "mine" {
+		t.Errorf("Content should not be modified, got: %s", b)
+	}
+
+	do(http.MethodGet, "/news/today", "", map[string]string{"If-None-Match": etag}, http.StatusOK)
+	do(http.MethodDelete, "/news/today", "", map[string]string{"If-Match": etag}, http.StatusPreconditionFailed)
+	do(http.MethodDelete, "/news/today", "", map[string]string{"If-Match": "*"}, http.StatusOK)
+}
+
+func TestRawContent(t *testing.T) {
+	store := NewMemoryStorage()
+	h := service(store, newPathLocker(), defaultConfig())
+
+	do := func(method, target, contentType, accept, body string, expectCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(contentType) > 0 {
+			req.Header.Set("CONTENT-TYPE", contentType)
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s %s, content-type: %s, accept: %s, want: %d, got: %d, body: %s", method, target, contentType, accept, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	text := "Hello \"world\"\n\tline 2 ✓\n"
+	do(http.MethodPost, "/news/today", "text/plain", "", text, http.StatusOK)
+	if b, _ := readFile(store, "/news/today.txt"); string(b) != text {
+		t.Errorf("Content is not same, want: %q, got: %q", text, b)
+	}
+
+	w := do(http.MethodGet, "/news/today", "", "text/plain", "", http.StatusOK)
+	if w.Body.String() != text {
+		t.Errorf("Content is not same, want: %q, got: %q", text, w.Body.String())
+	}
+	if mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type")); mediaType != "text/plain" {
+		t.Errorf("Unexpected content-type, got: %s", w.Header().Get("Content-Type"))
+	}
+
+	w = do(http.MethodGet, "/news/today", "", "", "", http.StatusOK)
+	c := contentBody{}
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || c.Content != text {
+		t.Errorf("Default response should be JSON envelope, got: %s, %v", w.Body.String(), err)
+	}
+
+	binary := "\x00\xff\xfe raw"
+	do(http.MethodPut, "/news/today", binaryContentType, "", binary, http.StatusOK)
+	w = do(http.MethodGet, "/news/today", "", binaryContentType, "", http.StatusOK)
+	if w.Body.String() != binary {
+		t.Errorf("Content is not same, want: %q, got: %q", binary, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != binaryContentType {
+		t.Errorf("Unexpected content-type, got: %s", w.Header().Get("Content-Type"))
+	}
+
+	do(http.MethodPut, "/news/today", "text/plain; charset=utf-8", "", "\xff\xfe", http.StatusBadRequest)
+	do(http.MethodPut, "/news/today", "text/plain; charset=big5", "", "hello", http.StatusUnsupportedMediaType)
+	do(http.MethodPut, "/news/today", "text/html", "", "hello", http.StatusUnsupportedMediaType)
+	do(http.MethodPut, "/news/today", "", "", "hello", http.StatusUnsupportedMediaType)
+	do(http.MethodPut, "/news/today", "text/plain", "", "", http.StatusBadRequest)
+	do(http.MethodGet, "/news/today", "", "text/html", "", http.StatusNotAcceptable)
+}
+
+// chunkedReader hides the length of the content, so requests are sent in chunked encoding
+type chunkedReader struct {
+	io.Reader
+}
+
+func TestStreamingContent(t *testing.T) {
+	store := NewMemoryStorage()
+	conf := defaultConfig()
+	conf.MaxBodySize = 1 << 20
+	h := service(store, newPathLocker(), conf)
+
+	do := func(method, target, contentType string, body io.Reader, expectCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		req.Header.Set("CONTENT-TYPE", contentType)
+		req.Header.Set("Accept", "text/plain")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s %s, want: %d, got: %d, body: %s", method, target, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	text := strings.Repeat("hello world ✓\n", 1<<15)
+	w := do(http.MethodPost, "/news/today", "text/plain", &chunkedReader{strings.NewReader(text)}, http.StatusOK)
+	if etag := contentETag(([]byte)(text)); w.Header().Get("ETag") != etag {
+		t.Errorf("Unexpected ETag, want: %s, got: %s", etag, w.Header().Get("ETag"))
+	}
+
+	w = do(http.MethodGet, "/news/today", "", nil, http.StatusOK)
+	if w.Body.String() != text {
+		t.Errorf("Content is not same, size: %d", w.Body.Len())
+	}
+	if w.Header().Get("Content-Length") != fmt.Sprint(len(text)) {
+		t.Errorf("Unexpected content-length, want: %d, got: %s", len(text), w.Header().Get("Content-Length"))
+	}
+
+	large := strings.Repeat("a", 1<<20+1)
+	do(http.MethodPut, "/news/today", "text/plain", &chunkedReader{strings.NewReader(large)}, http.StatusRequestEntityTooLarge)
+	do(http.MethodPut, "/news/today", binaryContentType, &chunkedReader{strings.NewReader(large)}, http.StatusRequestEntityTooLarge)
+	do(http.MethodPut, "/news/today", "text/plain", strings.NewReader(large), http.StatusRequestEntityTooLarge)
+	do(http.MethodPut, "/news/today", "text/plain", &chunkedReader{strings.NewReader("")}, http.StatusBadRequest)
+	do(http.MethodPut, "/news/today", "text/plain", &chunkedReader{strings.NewReader(text + "\xff")}, http.StatusBadRequest)
+	if b, _ := readFile(store, "/news/today.txt"); string(b) != text {
+		t.Errorf("Failed writes should keep the original content, size: %d", len(b))
+	}
+}
+
+// oneByteReader reads one byte at a time, so runes are split across reads
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) <= 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
+
+func TestUTF8Reader(t *testing.T) {
+	testFunc := func(data string, expectErr error) {
+		r := &utf8Reader{r: &oneByteReader{strings.NewReader(data)}}
+		b, err := ioutil.ReadAll(r)
+		if err != expectErr {
+			t.Errorf("Unexpected error, data: %q, want: %v, got: %v", data, expectErr, err)
+		} else if err == nil && string(b) != data {
+			t.Errorf("Unexpected data, want: %q, got: %q", data, b)
+		}
+	}
+
+	testFunc("", nil)
+	testFunc("hello", nil)
+	testFunc("中文 ✓ 😀", nil)
+	testFunc("\xff", errInvalidText)
+	testFunc("hello \xe4\xb8", errInvalidText)
+	testFunc("\xe4\xb8hello", errInvalidText)
+	testFunc("\xed\xa0\x80", errInvalidText)
+}
+
+func TestPartialContent(t *testing.T) {
+	store := NewMemoryStorage()
+	h := service(store, newPathLocker(), defaultConfig())
+
+	lines := make([]string, 0)
+	for i := 1; i <= 300; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	text := strings.Join(lines, "\n") + "\n"
+	if err := store.Put("/logs/app.txt", strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	etag := contentETag(([]byte)(text))
+
+	do := func(target, accept string, headers map[string]string, expectCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", accept)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s, headers: %v, want: %d, got: %d, body: %s", target, headers, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	w := do("/logs/app", "text/plain", map[string]string{"Range": "bytes=0-5"}, http.StatusPartialContent)
+	if w.Body.String() != "line 1" || w.Header().Get("Content-Range") != fmt.Sprintf("bytes 0-5/%d", len(text)) {
+		t.Errorf("Unexpected partial content, body: %q, content-range: %s", w.Body.String(), w.Header().Get("Content-Range"))
+	}
+	w = do("/logs/app", binaryContentType, map[string]string{"Range": "bytes=-4"}, http.StatusPartialContent)
+	if w.Body.String() != "300\n" {
+		t.Errorf("Unexpected suffix range, got: %q", w.Body.String())
+	}
+	w = do("/logs/app", "text/plain", map[string]string{"Range": "bytes=0-5,7-12"}, http.StatusPartialContent)
+	if mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type")); mediaType != "multipart/byteranges" {
+		t.Errorf("Unexpected content-type, got: %s", w.Header().Get("Content-Type"))
+	}
+	do("/logs/app", "text/plain", map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(text))}, http.StatusRequestedRangeNotSatisfiable)
+	do("/logs/app", "text/plain", map[string]string{"Range": "bytes=0-5", "If-Range": etag}, http.StatusPartialContent)
+	do("/logs/app", "text/plain", map[string]string{"Range": "bytes=0-5", "If-Range": `"outdated"`}, http.StatusOK)
+	do("/logs/app", "", map[string]string{"Range": "bytes=0-5"}, http.StatusOK)
+
+	w = do("/logs/app?lines=100-200", "text/plain", nil, http.StatusOK)
+	if expect := strings.Join(lines[99:200], "\n") + "\n"; w.Body.String() != expect {
+		t.Errorf("Unexpected lines, want: %q, got: %q", expect, w.Body.String())
+	}
+	w = do("/logs/app?lines=299-", "", nil, http.StatusOK)
+	c := contentBody{}
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || c.Content != "line 299\nline 300\n" {
+		t.Errorf("Unexpected lines, got: %s, %v", w.Body.String(), err)
+	}
+	do("/logs/app?lines=301-400", "text/plain", nil, http.StatusRequestedRangeNotSatisfiable)
+	do("/logs/app?lines=301-400", "", nil, http.StatusRequestedRangeNotSatisfiable)
+	do("/logs/app?lines=200-100", "text/plain", nil, http.StatusBadRequest)
+	do("/logs/app?lines=abc", "", nil, http.StatusBadRequest)
+}
+
+func TestPatchFileHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Storage{
+		"disk":   NewDiskStorage(dir, false),
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, store := range stores {
+		h := service(store, newPathLocker(), defaultConfig())
+		do := func(target string, headers map[string]string, body interface{}, expectCode int) *httptest.ResponseRecorder {
+			b, _ := json.Marshal(body)
+			req := httptest.NewRequest(http.MethodPatch, target, bytes.NewReader(b))
+			req.Header.Set("CONTENT-TYPE", jsonContentType)
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != expectCode {
+				t.Errorf("Unexpected code, storage: %s, body: %+v, want: %d, got: %d, response: %s", name, body, expectCode, w.Code, w.Body.String())
+			}
+			return w
+		}
+		expectFile := func(expect string) {
+			if b, err := readFile(store, "/logs/app.txt"); err != nil {
+				t.Fatal(err)
+			} else if string(b) != expect {
+				t.Errorf("Content is not same, storage: %s, want: %q, got: %q", name, expect, b)
+			}
+		}
+
+		do("/logs/app", nil, patchBody{Op: "append", Content: "a\n"}, http.StatusNotFound)
+		if err := store.Put("/logs/app.txt", strings.NewReader("a\nb\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		w := do("/logs/app", nil, patchBody{Op: "append", Content: "c\n"}, http.StatusOK)
+		expectFile("a\nb\nc\n")
+		if etag := contentETag(([]byte)("a\nb\nc\n")); w.Header().Get("ETag") != etag {
+			t.Errorf("Unexpected ETag, want: %s, got: %s", etag, w.Header().Get("ETag"))
+		}
+		etag := w.Header().Get("ETag")
+
+		do("/logs/app", map[string]string{"If-Match": etag}, patchBody{Op: "insert", Line: 2, Content: "a.1"}, http.StatusOK)
+		expectFile("a\na.1\nb\nc\n")
+		do("/logs/app", map[string]string{"If-Match": etag}, patchBody{Op: "append", Content: "d\n"}, http.StatusPreconditionFailed)
+		do("/logs/app", nil, patchBody{Op: "replace", Lines: "2-3", Content: "B\n"}, http.StatusOK)
+		expectFile("a\nB\nc\n")
+		do("/logs/app", nil, patchBody{Op: "diff", Content: "@@ -2,2 +2 @@\n-B\n-c\n+b\n"}, http.StatusOK)
+		expectFile("a\nb\n")
+
+		do("/logs/app", nil, patchBody{Op: "replace", Lines: "2-5", Content: "x"}, http.StatusConflict)
+		do("/logs/app", nil, patchBody{Op: "diff", Content: "@@ -2 +2 @@\n-c\n+x\n"}, http.StatusConflict)
+		do("/logs/app", nil, patchBody{Op: "diff", Content: "not a diff"}, http.StatusBadRequest)
+		do("/logs/app", nil, patchBody{Op: "unknown"}, http.StatusBadRequest)
+		do("/logs/app", nil, struct{ Op, Code string }{"append", "x"}, http.StatusBadRequest)
+		expectFile("a\nb\n")
+	}
+}
+
+func TestHeadAndOptions(t *testing.T) {
+	store := NewMemoryStorage()
+	h := service(store, newPathLocker(), defaultConfig())
+	text := "Hello world,\nnew line 2\n"
+	if err := store.Put("/news/today.txt", strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, target, accept string, expectCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s %s, want: %d, got: %d, body: %s", method, target, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	for _, accept := range []string{"", "text/plain", "application/octet-stream"} {
+		get := do(http.MethodGet, "/news/today", accept, http.StatusOK)
+		head := do(http.MethodHead, "/news/today", accept, http.StatusOK)
+		if head.Body.Len() > 0 {
+			t.Errorf("HEAD should not response body, got: %s", head.Body.String())
+		}
+		// Content of JSON envelope is not read by HEAD, so its length is unknown
+		expectLength := fmt.Sprint(get.Body.Len())
+		if len(accept) <= 0 {
+			expectLength = ""
+		}
+		if head.Header().Get("Content-Length") != expectLength {
+			t.Errorf("Unexpected content-length, accept: %s, want: %s, got: %s", accept, expectLength, head.Header().Get("Content-Length"))
+		}
+		for _, k := range []string{"Content-Type", "ETag", "Last-Modified", "X-Word-Count", "X-Line-Count"} {
+			if v := head.Header().Get(k); len(v) <= 0 || v != get.Header().Get(k) {
+				t.Errorf("Header should be same as GET, accept: %s, key: %s, want: %s, got: %s", accept, k, get.Header().Get(k), v)
+			}
+		}
+	}
+
+	head := do(http.MethodHead, "/news/today", "", http.StatusOK)
+	if head.Header().Get("X-Word-Count") != "4" || head.Header().Get("X-Line-Count") != "2" {
+		t.Errorf("Unexpected counts, words: %s, lines: %s", head.Header().Get("X-Word-Count"), head.Header().Get("X-Line-Count"))
+	}
+	do(http.MethodHead, "/news/", "", http.StatusOK)
+	do(http.MethodHead, "/news/?list", "", http.StatusOK)
+	do(http.MethodHead, "/news/none", "", http.StatusNotFound)
+	do(http.MethodHead, "/news/today", "text/html", http.StatusNotAcceptable)
+	do(http.MethodHead, "/news/today?lines=2", "text/plain", http.StatusOK)
+	do(http.MethodHead, "/news/today?lines=3", "text/plain", http.StatusRequestedRangeNotSatisfiable)
+	do(http.MethodGet, "/news/today?lines=3", "text/plain", http.StatusRequestedRangeNotSatisfiable)
+
+	// HEAD does not read the content, and counts are read once until the file changes
+	counting := &countingStorage{Storage: store}
+	h = service(counting, newPathLocker(), defaultConfig())
+	for i := 0; i < 3; i++ {
+		do(http.MethodHead, "/news/today", "", http.StatusOK)
+		do(http.MethodHead, "/news/today?lines=1", "text/plain", http.StatusOK)
+		do(http.MethodHead, "/news/today", "text/plain", http.StatusOK)
+	}
+	if counting.bytes != int64(len(text)) {
+		t.Errorf("Unexpected bytes read, want: %d, got: %d", len(text), counting.bytes)
+	}
+
+	testFunc := func(target string, expectCode int, expectAllow string) {
+		w := do(http.MethodOptions, target, "", expectCode)
+		if w.Header().Get("Allow") != expectAllow {
+			t.Errorf("Unexpected allow, %s, want: %s, got: %s", target, expectAllow, w.Header().Get("Allow"))
+		}
+	}
+	testFunc("/news/today", http.StatusNoContent, "GET, HEAD, PUT, PATCH, DELETE, MOVE, COPY, OPTIONS")
+	testFunc("/news/none", http.StatusNoContent, "POST, OPTIONS")
+	testFunc("/news/", http.StatusNoContent, "GET, HEAD, DELETE, MOVE, COPY, OPTIONS")
+	testFunc("/", http.StatusNoContent, "GET, HEAD, OPTIONS")
+	testFunc("/none/", http.StatusNotFound, "")
+	testFunc("/.hidden", http.StatusForbidden, "")
+}
+
+func TestTransferHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Storage{
+		"disk":   NewDiskStorage(dir, false),
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, store := range stores {
+		for fileName, content := range map[string]string{
+			"/news/today.txt":        "today",
+			"/news/yesterday.txt":    "yesterday",
+			"/news/2018/old.txt":     "old",
+			"/news/2018/12/xmas.txt": "xmas",
+			"/archive/keep.txt":      "keep",
+		} {
+			if err := store.Put(fileName, strings.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		h := service(store, newPathLocker(), defaultConfig())
+		do := func(method, target string, headers map[string]string, expectCode int) {
+			req := httptest.NewRequest(method, target, nil)
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != expectCode {
+				t.Errorf("Unexpected code, storage: %s, %s %s, headers: %v, want: %d, got: %d, body: %s", name, method, target, headers, expectCode, w.Code, w.Body.String())
+			}
+		}
+		dest := func(destination string) map[string]string {
+			return map[string]string{"Destination": destination}
+		}
+		expectFile := func(fileName, expect string) {
+			b, err := readFile(store, fileName)
+			if expect == "" && !os.IsNotExist(err) {
+				t.Errorf("File should not exist, storage: %s, name: %s, got: %s, %v", name, fileName, b, err)
+			} else if expect != "" && string(b) != expect {
+				t.Errorf("Content is not same, storage: %s, name: %s, want: %s, got: %s, %v", name, fileName, expect, b, err)
+			}
+		}
+		// Replaced files are recoverable from trash
+		expectTrashed := func(path, expect string) {
+			items, err := listTrash(store, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 1 || items[0].Path != path {
+				t.Errorf("Unexpected trash items, storage: %s, path: %s, want: 1, got: %d", name, path, len(items))
+				return
+			}
+			expectFile(items[0].contentName(), expect)
+		}
+
+		do("MOVE", "/news/today", dest("/news/renamed"), http.StatusCreated)
+		expectFile("/news/today.txt", "")
+		expectFile("/news/renamed.txt", "today")
+		do("COPY", "/news/renamed", dest("http://example.com/copies/renamed"), http.StatusCreated)
+		expectFile("/news/renamed.txt", "today")
+		expectFile("/copies/renamed.txt", "today")
+
+		do("MOVE", "/news/yesterday", map[string]string{"Destination": "/news/renamed", "Overwrite": "F"}, http.StatusPreconditionFailed)
+		do("MOVE", "/news/yesterday", map[string]string{"Destination": "/news/renamed", "If-Match": `"outdated"`}, http.StatusPreconditionFailed)
+		do("MOVE", "/news/yesterday", dest("/news/renamed"), http.StatusNoContent)
+		expectFile("/news/renamed.txt", "yesterday")
+		expectFile("/news/yesterday.txt", "")
+		expectTrashed("/news/renamed", "today")
+
+		do("COPY", "/news/2018/", dest("/backup/2018/"), http.StatusCreated)
+		expectFile("/backup/2018/12/xmas.txt", "xmas")
+		expectFile("/news/2018/old.txt", "old")
+		do("MOVE", "/news/2018/", map[string]string{"Destination": "/archive/", "Overwrite": "F"}, http.StatusPreconditionFailed)
+		do("MOVE", "/backup/2018/", map[string]string{"Destination": "/archive/2018/", "Overwrite": "F"}, http.StatusCreated)
+		do("MOVE", "/news/2018/", map[string]string{"Destination": "/archive/2018/", "Overwrite": "F"}, http.StatusPreconditionFailed)
+		if err := store.Put("/archive/2018/stale.txt", strings.NewReader("stale")); err != nil {
+			t.Fatal(err)
+		}
+		do("MOVE", "/news/2018/", dest("/archive/2018/"), http.StatusNoContent)
+		expectFile("/archive/2018/old.txt", "old")
+		expectFile("/archive/2018/stale.txt", "")
+		expectFile("/news/2018/old.txt", "")
+		expectTrashed("/archive/2018/stale", "stale")
+
+		do("MOVE", "/news/none", dest("/news/other"), http.StatusNotFound)
+		do("MOVE", "/news/renamed", dest("/news/renamed"), http.StatusForbidden)
+		do("MOVE", "/news/renamed", dest("/news/renamed/"), http.StatusBadRequest)
+		do("MOVE", "/archive/", dest("/archive/2018/inner/"), http.StatusBadRequest)
+		do("MOVE", "/news/renamed", dest("/archive/keep/x"), http.StatusCreated)
+		if err := store.Put("/archive/dir.txt/inner.txt", strings.NewReader("inner")); err != nil {
+			t.Fatal(err)
+		}
+		do("MOVE", "/archive/keep/x", dest("/archive/dir"), http.StatusConflict)
+		do("MOVE", "/archive/keep/x", dest("/copies/renamed.txt/x"), http.StatusConflict)
+		do("MOVE", "/archive/keep/x", dest("/.hidden"), http.StatusForbidden)
+		do("MOVE", "/archive/keep/x", map[string]string{"Destination": "/x", "Overwrite": "maybe"}, http.StatusBadRequest)
+		do("MOVE", "/archive/keep/x", nil, http.StatusBadRequest)
+		do("COPY", "/", dest("/root/"), http.StatusBadRequest)
+	}
+}
+
+func TestRemoveFolderHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Storage{
+		"disk":   NewDiskStorage(dir, false),
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, store := range stores {
+		for _, fileName := range []string{"/news/today.txt", "/news/2018/old.txt", "/news/2018/12/xmas.txt", "/a/b/c/file.txt", "/a/keep.txt"} {
+			if err := store.Put(fileName, strings.NewReader("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		h := service(store, newPathLocker(), defaultConfig())
+		do := func(target string, expectCode int) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodDelete, target, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != expectCode {
+				t.Errorf("Unexpected code, storage: %s, DELETE %s, want: %d, got: %d, body: %s", name, target, expectCode, w.Code, w.Body.String())
+			}
+			return w
+		}
+		exists := func(fileName string, expect bool) {
+			if _, err := store.Stat(fileName); (err == nil) != expect {
+				t.Errorf("Unexpected existence, storage: %s, name: %s, want: %v, got: %v", name, fileName, expect, err)
+			}
+		}
+
+		do("/news/", http.StatusConflict)
+		w := do("/news/?recursive=true&dry-run=true", http.StatusOK)
+		r := removal{}
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if expect := "/news/2018/12/xmas,/news/2018/12/,/news/2018/old,/news/2018/,/news/today,/news/"; !r.DryRun || strings.Join(r.Removed, ",") != expect {
+			t.Errorf("Unexpected removal, storage: %s, want: %s, got: %+v", name, expect, r)
+		}
+		exists("/news/2018/12/xmas.txt", true)
+
+		w = do("/news/2018/?recursive=true", http.StatusOK)
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil || r.DryRun || len(r.Removed) != 4 {
+			t.Errorf("Unexpected removal, storage: %s, got: %s", name, w.Body.String())
+		}
+		exists("/news/2018/", false)
+		exists("/news/today.txt", true)
+
+		do("/a/b/c/file", http.StatusOK)
+		exists("/a/b/c/", true)
+		do("/a/b/c/missing?prune=true", http.StatusNotFound)
+		exists("/a/b/c/", true)
+		if err := store.Put("/a/b/c/file.txt", strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+		do("/a/b/c/file?prune=true", http.StatusOK)
+		exists("/a/b/", false)
+		exists("/a/keep.txt", true)
+		do("/a/keep?prune=true", http.StatusOK)
+		exists("/a/", false)
+		exists("/", true)
+
+		do("/news/none/", http.StatusNotFound)
+		do("/news/?recursive=maybe", http.StatusBadRequest)
+		do("/news/today?prune=maybe", http.StatusBadRequest)
+		do("/", http.StatusForbidden)
+		do("/?recursive=true", http.StatusForbidden)
+		exists("/news/today.txt", true)
+	}
+}
+
+func TestTrashHandlers(t *testing.T) {
+	store := NewMemoryStorage()
+	for _, fileName := range []string{"/news/today.txt", "/news/2018/old.txt", "/news/2018/old.bin"} {
+		if err := store.Put(fileName, strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := service(store, newPathLocker(), defaultConfig())
+	do := func(method, target string, expectCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-Operator", "tool")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s %s, want: %d, got: %d, body: %s", method, target, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+	list := func(target string, expect int) []*trashItem {
+		items := make([]*trashItem, 0)
+		if err := json.Unmarshal(do(http.MethodGet, target, http.StatusOK).Body.Bytes(), &items); err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != expect {
+			t.Errorf("Unexpected items, GET %s, want: %d, got: %d", target, expect, len(items))
+		}
+		return items
+	}
+
+	do(http.MethodDelete, "/news/today", http.StatusOK)
+	do(http.MethodDelete, "/news/2018/?recursive=true", http.StatusOK)
+	if _, err := store.Stat("/news/2018/old.bin"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected stat, want: not exist, got: %v", err)
+	}
+	list("/.trash/", 2)
+	list("/.trash/?path=/news/2018/", 1)
+	items := list("/.trash/?path=/news/", 2)
+	if items[0].Path != "/news/2018/old" || items[0].Operator != "tool" || items[1].Path != "/news/today" {
+		t.Errorf("Unexpected items, got: %+v, %+v", items[0], items[1])
+	}
+
+	today := items[1]
+	w := do(http.MethodGet, "/.trash/"+today.ID, http.StatusOK)
+	item := trashItem{}
+	if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil || item.ID != today.ID {
+		t.Errorf("Unexpected item, want: %s, got: %s", today.ID, w.Body.String())
+	}
+	do(http.MethodGet, "/.trash/none", http.StatusNotFound)
+	do(http.MethodGet, "/.trash/"+today.ID+".txt", http.StatusNotFound)
+
+	if err := store.Put("/news/today.txt", strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	do(http.MethodPost, "/.trash/"+today.ID+"/restore", http.StatusConflict)
+	do(http.MethodDelete, "/news/today", http.StatusOK)
+	do(http.MethodPost, "/.trash/"+today.ID+"/restore", http.StatusOK)
+	w = do(http.MethodGet, "/news/today", http.StatusOK)
+	if got := w.Body.String(); got != `{"Content":"hello"}` {
+		t.Errorf("Unexpected content, want: hello, got: %s", got)
+	}
+	do(http.MethodPost, "/.trash/"+today.ID+"/restore", http.StatusNotFound)
+
+	items = list("/.trash/", 2)
+	do(http.MethodDelete, "/.trash/"+items[0].ID, http.StatusOK)
+	do(http.MethodDelete, "/.trash/"+items[0].ID, http.StatusNotFound)
+	list("/.trash/", 1)
+	do(http.MethodDelete, "/.trash/", http.StatusOK)
+	list("/.trash/", 0)
+	do(http.MethodGet, "/.trash/x.txt", http.StatusNotFound)
+	do(http.MethodPut, "/.trash/x", http.StatusForbidden)
+}
+
+func TestRevisionsFollowFiles(t *testing.T) {
+	store := NewMemoryStorage()
+	h := service(store, newPathLocker(), defaultConfig())
+	conf := defaultConfig()
+	conf.Trash = false
+	noTrash := service(store, newPathLocker(), conf)
+	do := func(h http.Handler, method, target, body string, header map[string]string, expectCode int) *httptest.ResponseRecorder {
+		var r io.Reader
+		if len(body) > 0 {
+			r = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, target, r)
+		req.Header.Set("CONTENT-TYPE", "text/plain")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s %s, want: %d, got: %d, body: %s", method, target, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+	list := func(target string, expect int) []*revision {
+		revs := make([]*revision, 0)
+		if err := json.Unmarshal(do(h, http.MethodGet, target+"?versions", "", nil, http.StatusOK).Body.Bytes(), &revs); err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != expect {
+			t.Errorf("Unexpected revisions, GET %s?versions, want: %d, got: %d", target, expect, len(revs))
+		}
+		return revs
+	}
+	missing := func(target string) {
+		do(h, http.MethodGet, target+"?versions", "", nil, http.StatusNotFound)
+	}
+	trashItems := func() []*trashItem {
+		items := make([]*trashItem, 0)
+		if err := json.Unmarshal(do(h, http.MethodGet, "/.trash/", "", nil, http.StatusOK).Body.Bytes(), &items); err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	do(h, http.MethodPost, "/news/today", "hello", nil, http.StatusOK)
+	do(h, http.MethodPut, "/news/today", "world", nil, http.StatusOK)
+	rev := list("/news/today", 1)[0]
+
+	// Trash and restore
+	do(h, http.MethodDelete, "/news/today", "", nil, http.StatusOK)
+	missing("/news/today")
+	do(h, http.MethodGet, "/news/today?version="+rev.ID, "", nil, http.StatusNotFound)
+	do(h, http.MethodPost, "/.trash/"+trashItems()[0].ID+"/restore", "", nil, http.StatusOK)
+	list("/news/today", 1)
+
+	// Move a file and a folder
+	do(h, "MOVE", "/news/today", "", map[string]string{"Destination": "/news/moved"}, http.StatusCreated)
+	missing("/news/today")
+	list("/news/moved", 1)
+	do(h, "MOVE", "/news/", "", map[string]string{"Destination": "/archive/"}, http.StatusCreated)
+	list("/archive/moved", 1)
+
+	// Copies start without revisions
+	do(h, "COPY", "/archive/moved", "", map[string]string{"Destination": "/archive/copied"}, http.StatusCreated)
+	list("/archive/copied", 0)
+
+	// Purge
+	do(h, http.MethodDelete, "/archive/moved", "", nil, http.StatusOK)
+	do(h, http.MethodDelete, "/.trash/"+trashItems()[0].ID, "", nil, http.StatusOK)
+	do(h, http.MethodPost, "/archive/moved", "new", nil, http.StatusOK)
+	list("/archive/moved", 0)
+	do(h, http.MethodGet, "/archive/moved?version="+rev.ID, "", nil, http.StatusNotFound)
+
+	// Permanent deletion
+	do(h, http.MethodPut, "/archive/moved", "newer", nil, http.StatusOK)
+	list("/archive/moved", 1)
+	do(noTrash, http.MethodDelete, "/archive/moved", "", nil, http.StatusOK)
+	missing("/archive/moved")
+
+	// Revisions left by a file removed outside of the service are not attached to a new file
+	if _, err := saveRevision(store, "/archive/copied.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("/archive/copied.txt"); err != nil {
+		t.Fatal(err)
+	}
+	do(h, http.MethodPost, "/archive/copied", "new", nil, http.StatusOK)
+	list("/archive/copied", 0)
+}
+
+// getHookStorage is a Storage that calls onGet before Get
+type getHookStorage struct {
+	Storage
+	onGet func(name string)
+}
+
+func (s *getHookStorage) Get(name string) (File, error) {
+	s.onGet(name)
+	return s.Storage.Get(name)
+}
+
+func TestRetrieveFileHandlerConsistent(t *testing.T) {
+	var h http.Handler
+	armed := int32(0)
+	replaced := make(chan int)
+	store := &getHookStorage{NewMemoryStorage(), func(name string) {
+		if name != "/news/today.txt" || !atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			return
+		}
+		// A writer arrives while the file is opened
+		go func() {
+			req := httptest.NewRequest(http.MethodPut, "/news/today", strings.NewReader("replaced"))
+			req.Header.Set("Content-Type", "text/plain")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			replaced <- w.Code
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}}
+	h = service(store, newPathLocker(), defaultConfig())
+
+	req := httptest.NewRequest(http.MethodPost, "/news/today", strings.NewReader("original"))
+	req.Header.Set("Content-Type", "text/plain")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	atomic.StoreInt32(&armed, 1)
+	req = httptest.NewRequest(http.MethodGet, "/news/today", nil)
+	req.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if etag := contentETag(w.Body.Bytes()); w.Header().Get("ETag") != etag {
+		t.Errorf("Unexpected ETag of content served, content: %s, want: %s, got: %s", w.Body.String(), etag, w.Header().Get("ETag"))
+	}
+	if code := <-replaced; code != http.StatusOK {
+		t.Errorf("Unexpected code of PUT, want: %d, got: %d", http.StatusOK, code)
+	}
+}
+
+func TestRestoreTrashHandlerLocks(t *testing.T) {
+	base := NewMemoryStorage()
+	if err := base.Put("/news/today.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	item, err := trashFile(base, "/news/today.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer of the root folder arrives while the item is read
+	locks := newPathLocker()
+	writerDone := make(chan struct{})
+	once := sync.Once{}
+	store := &getHookStorage{base, func(name string) {
+		once.Do(func() {
+			go func() {
+				unlock := locks.Lock("/")
+				unlock()
+				close(writerDone)
+			}()
+			time.Sleep(50 * time.Millisecond)
+		})
+	}}
+
+	h := restoreTrashHandler(store, locks)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/.trash/"+item.ID+"/restore", nil), map[string]string{"id": item.ID})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		done <- w
+	}()
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK {
+			t.Errorf("Unexpected code, want: %d, got: %d, body: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Restore is blocked")
+	}
+	<-writerDone
+	if _, err := base.Stat("/news/today.txt"); err != nil {
+		t.Errorf("Unexpected stat, want: nil, got: %v", err)
+	}
+}
+
+func TestVersionsHandlers(t *testing.T) {
+	store := NewMemoryStorage()
+	conf := defaultConfig()
+	conf.VersionLimit = 3
+	h := service(store, newPathLocker(), conf)
+	do := func(method, target, body string, expectCode int) *httptest.ResponseRecorder {
+		var r io.Reader
+		if len(body) > 0 {
+			r = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, target, r)
+		req.Header.Set("CONTENT-TYPE", "text/plain")
+		req.Header.Set("Accept", "text/plain")
+		req.Header.Set("X-Operator", "tool")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s %s, want: %d, got: %d, body: %s", method, target, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+	list := func(expect int) []*revision {
+		revs := make([]*revision, 0)
+		if err := json.Unmarshal(do(http.MethodGet, "/news/today?versions", "", http.StatusOK).Body.Bytes(), &revs); err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != expect {
+			t.Errorf("Unexpected revisions, want: %d, got: %d", expect, len(revs))
+		}
+		return revs
+	}
+	content := func(target, expect string) {
+		if got := do(http.MethodGet, target, "", http.StatusOK).Body.String(); got != expect {
+			t.Errorf("Unexpected content, GET %s, want: %q, got: %q", target, expect, got)
+		}
+	}
+
+	do(http.MethodGet, "/news/today?versions", "", http.StatusNotFound)
+	do(http.MethodPost, "/news/today", "a\nb\nc\n", http.StatusOK)
+	list(0)
+	do(http.MethodPut, "/news/today", "a\nx\nc\n", http.StatusOK)
+	do(http.MethodPut, "/news/today", "\xff", http.StatusBadRequest)
+	revs := list(1)
+	first := revs[0].ID
+	if revs[0].Operator != "tool" || revs[0].Size != 6 {
+		t.Errorf("Unexpected revision, got: %+v", revs[0])
+	}
+
+	content("/news/today?version="+first, "a\nb\nc\n")
+	req := httptest.NewRequest(http.MethodGet, "/news/today?version="+first, nil)
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("Range", "bytes=2-3")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "b\n" || w.Header().Get("Last-Modified") != revs[0].Time.UTC().Format(http.TimeFormat) {
+		t.Errorf("Unexpected range of revision, want: %d %q, got: %d %q, header: %v", http.StatusPartialContent, "b\n", w.Code, w.Body.String(), w.Header())
+	}
+	content("/news/today?diff="+first, "--- /news/today@"+first+"\n+++ /news/today@current\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n")
+	content("/news/today?diff=current&to="+first, "--- /news/today@current\n+++ /news/today@"+first+"\n@@ -1,3 +1,3 @@\n a\n-x\n+b\n c\n")
+	do(http.MethodGet, "/news/today?version=none", "", http.StatusNotFound)
+	do(http.MethodGet, "/news/today?diff=none", "", http.StatusNotFound)
+	do(http.MethodGet, "/news/none?diff=current", "", http.StatusNotFound)
+
+	do(http.MethodPut, "/news/today?rollback=none", "", http.StatusNotFound)
+	do(http.MethodPut, "/news/today?rollback="+first, "", http.StatusOK)
+	content("/news/today", "a\nb\nc\n")
+	revs = list(2)
+	content("/news/today?version="+revs[0].ID, "a\nx\nc\n")
+
+	for i := 0; i < 3; i++ {
+		do(http.MethodPut, "/news/today", fmt.Sprintf("%d\n", i), http.StatusOK)
+	}
+	revs = list(3)
+	if revs[len(revs)-1].ID == first {
+		t.Errorf("Unexpected revision, want: pruned, got: %s", first)
+	}
+	do(http.MethodPut, "/news/today?rollback="+first, "", http.StatusNotFound)
+}
+
+func TestVersionsHandlerLocks(t *testing.T) {
+	var h http.Handler
+	armed := int32(0)
+	replaced := make(chan int)
+	store := &getHookStorage{NewMemoryStorage(), func(name string) {
+		if !strings.HasPrefix(name, revisionsFolder("/news/today.txt")) || !atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			return
+		}
+		// A writer prunes the revision while it is read
+		go func() {
+			req := httptest.NewRequest(http.MethodPut, "/news/today", strings.NewReader("third"))
+			req.Header.Set("Content-Type", "text/plain")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			replaced <- w.Code
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}}
+	conf := defaultConfig()
+	conf.VersionLimit = 1
+	h = service(store, newPathLocker(), conf)
+	for _, r := range []struct{ method, body string }{{http.MethodPost, "first"}, {http.MethodPut, "second"}} {
+		req := httptest.NewRequest(r.method, "/news/today", strings.NewReader(r.body))
+		req.Header.Set("Content-Type", "text/plain")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	revs, err := listRevisions(store, "/news/today.txt")
+	if err != nil || len(revs) != 1 {
+		t.Fatalf("Unexpected revisions, want: 1, got: %d, err: %v", len(revs), err)
+	}
+
+	atomic.StoreInt32(&armed, 1)
+	req := httptest.NewRequest(http.MethodGet, "/news/today?version="+revs[0].ID, nil)
+	req.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "first" {
+		t.Errorf("Unexpected revision content, want: %d %q, got: %d %q", http.StatusOK, "first", w.Code, w.Body.String())
+	}
+	if code := <-replaced; code != http.StatusOK {
+		t.Errorf("Unexpected code of PUT, want: %d, got: %d", http.StatusOK, code)
+	}
+}
+
+func TestDirHandler(t *testing.T) {
+	const pathPrefix = "/"
+	store := NewMemoryStorage()
+	for _, fileName := range []string{"/news/today.txt", "/news/2018/old.txt", "/news/2018/12/xmas.txt"} {
+		if err := store.Put(fileName, strings.NewReader("hello world")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("/news/2018/12/xmas.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := dirHandler(store, nil, pathPrefix, 2)
+	testFunc := func(target string, expectCode int, expectFiles int, expectFolders string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, GET %s, want: %d, got: %d, body: %s", target, expectCode, w.Code, w.Body.String())
+			return
+		}
+		if expectCode != http.StatusOK {
+			return
+		}
+
+		s := folderStat{}
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		folders := make([]string, 0)
+		var walk func(prefix string, s *folderStat)
+		walk = func(prefix string, s *folderStat) {
+			for _, sub := range s.Folders {
+				folders = append(folders, fmt.Sprintf("%s%s%d", prefix, sub.Name, sub.NumFiles))
+				walk(prefix+sub.Name, sub)
+			}
+		}
+		walk("", &s)
+		if s.NumFiles != expectFiles || strings.Join(folders, ",") != expectFolders {
+			t.Errorf("Unexpected stat, GET %s, want: %d %s, got: %d %s", target, expectFiles, expectFolders, s.NumFiles, strings.Join(folders, ","))
+		}
+	}
+
+	testFunc("/news/", http.StatusOK, 1, "")
+	testFunc("/news/?recursive=true", http.StatusOK, 2, "2018/1,2018/12/0")
+	testFunc("/news/?recursive=true&depth=1", http.StatusOK, 2, "2018/1")
+	testFunc("/news/2018/12/", http.StatusOK, 0, "")
+	testFunc("/news/?recursive=maybe", http.StatusBadRequest, 0, "")
+	testFunc("/news/?recursive=true&depth=0", http.StatusBadRequest, 0, "")
+	testFunc("/none/?recursive=true", http.StatusNotFound, 0, "")
+	testFunc("/news/?extended=maybe", http.StatusBadRequest, 0, "")
+
+	extendedFunc := func(target string) *folderStat {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected code, GET %s, want: %d, got: %d, body: %s", target, http.StatusOK, w.Code, w.Body.String())
+		}
+		s := &folderStat{}
+		if err := json.Unmarshal(w.Body.Bytes(), s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if s := extendedFunc("/news/?recursive=true"); s.Extended != nil {
+		t.Errorf("Unexpected Extended, GET /news/?recursive=true, want: nil, got: %+v", s.Extended)
+	}
+	s := extendedFunc("/news/?recursive=true&extended=true")
+	if s.Extended == nil || s.Extended.FileSize == nil || s.Extended.FileSize.Median != 11 || s.Extended.WordLength.P99 != 5 {
+		t.Errorf("Unexpected Extended, GET /news/?recursive=true&extended=true, got: %+v", s.Extended)
+	} else if !reflect.DeepEqual(s.Extended.FileSizeHistogram, []histogramBin{{8, 15, 2}}) {
+		t.Errorf("Unexpected FileSizeHistogram, want: %v, got: %v", []histogramBin{{8, 15, 2}}, s.Extended.FileSizeHistogram)
+	}
+	if len(s.Folders) != 1 || len(s.Folders[0].Folders) != 1 {
+		t.Fatalf("Unexpected Folders, got: %+v", s.Folders)
+	}
+	// Distributions of a folder without files are absent
+	if e := s.Folders[0].Folders[0].Extended; e == nil || e.FileSize != nil || e.WordLength != nil || len(e.FileSizeHistogram) != 0 {
+		t.Errorf("Unexpected Extended of empty folder, got: %+v", e)
+	}
+}
+
+func TestFileStatsHandler(t *testing.T) {
+	store := NewMemoryStorage()
+	if err := store.Put("/news/today.txt", strings.NewReader("Hello world.\nHello again!\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := service(store, newPathLocker(), defaultConfig())
+	do := func(target, etag string, expectCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if len(etag) > 0 {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, GET %s, want: %d, got: %d, body: %s", target, expectCode, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	w := do("/news/today?stats", "", http.StatusOK)
+	s := fileStatistics{}
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.NumWords != 4 || s.NumUniqueWords != 3 || s.NumLines != 2 || s.NumSentences != 2 || s.TotalBytes != 26 {
+		t.Errorf("Unexpected statistics, got: %+v", s)
+	}
+	if etag := w.Header().Get("ETag"); etag != contentETag([]byte("Hello world.\nHello again!\n")) {
+		t.Errorf("Unexpected ETag, got: %s", etag)
+	}
+	do("/news/today?stats", w.Header().Get("ETag"), http.StatusNotModified)
+	do("/news/none?stats", "", http.StatusNotFound)
+}
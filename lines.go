@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var errInvalidLineRange = errors.New("invalid line range")
+
+// lineRange is a 1-based inclusive range of lines, last is 0 if the range is open ended
+type lineRange struct {
+	first int
+	last  int
+}
+
+// parseLineRange parses the line range, e.g. "100-200", "100-" (to the end) or "100" (single line)
+func parseLineRange(s string) (lineRange, error) {
+	first, last := strings.TrimSpace(s), ""
+	ranged := false
+	if i := strings.Index(first, "-"); i >= 0 {
+		first, last, ranged = strings.TrimSpace(first[:i]), strings.TrimSpace(first[i+1:]), true
+	}
+
+	r := lineRange{}
+	var err error
+	if r.first, err = strconv.Atoi(first); err != nil || r.first < 1 {
+		return lineRange{}, errInvalidLineRange
+	}
+	switch {
+	case !ranged:
+		r.last = r.first
+	case len(last) > 0:
+		if r.last, err = strconv.Atoi(last); err != nil || r.last < r.first {
+			return lineRange{}, errInvalidLineRange
+		}
+	}
+	return r, nil
+}
+
+// copyLines copies the lines in range from r to w
+//
+// Lines are separated by "\n", which is kept in the output. It returns io.EOF if r has fewer lines than lr.first
+func copyLines(w io.Writer, r io.Reader, lr lineRange) error {
+	br := bufio.NewReader(r)
+	for line := 1; lr.last <= 0 || line <= lr.last; line++ {
+		dst := w
+		if line < lr.first {
+			dst = ioutil.Discard
+		}
+		if _, err := copyLine(dst, br); err == io.EOF {
+			if line <= lr.first {
+				return io.EOF
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyLine copies the next line from r to w, and reports whether the line ends with "\n"
+//
+// Long lines are copied in pieces, so they are never held in memory. It returns io.EOF if there are no more lines
+func copyLine(w io.Writer, r *bufio.Reader) (bool, error) {
+	read := false
+	for {
+		b, err := r.ReadSlice('\n')
+		if len(b) > 0 {
+			if _, err := w.Write(b); err != nil {
+				return false, err
+			}
+			read = true
+		}
+		switch err {
+		case nil:
+			return true, nil
+		case bufio.ErrBufferFull:
+			// Long line, keep reading the same line
+		case io.EOF:
+			if !read {
+				return false, io.EOF
+			}
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+}
+
+// readLine reads the next line from r, including the "\n" if any. It returns io.EOF if there are no more lines
+func readLine(r *bufio.Reader) (string, error) {
+	b := strings.Builder{}
+	if _, err := copyLine(&b, r); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// lineCounter is a io.Writer that counts lines written, in the same way as copyLines
+type lineCounter struct {
+	lines   int
+	newline bool
+	written bool
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	if len(p) <= 0 {
+		return 0, nil
+	}
+	c.lines += bytes.Count(p, []byte("\n"))
+	c.newline = p[len(p)-1] == '\n'
+	c.written = true
+	return len(p), nil
+}
+
+// Lines returns the number of lines, the last line may not end with "\n"
+func (c *lineCounter) Lines() int {
+	if c.written && !c.newline {
+		return c.lines + 1
+	}
+	return c.lines
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseLineRange(t *testing.T) {
+	testFunc := func(s string, expectRange lineRange, expectErr error) {
+		r, err := parseLineRange(s)
+		if err != expectErr || r != expectRange {
+			t.Errorf("Unexpected result, s: %s, want: %v %v, got: %v %v", s, expectRange, expectErr, r, err)
+		}
+	}
+
+	testFunc("100-200", lineRange{100, 200}, nil)
+	testFunc(" 1 - 1 ", lineRange{1, 1}, nil)
+	testFunc("100-", lineRange{100, 0}, nil)
+	testFunc("7", lineRange{7, 7}, nil)
+	testFunc("", lineRange{}, errInvalidLineRange)
+	testFunc("0-10", lineRange{}, errInvalidLineRange)
+	testFunc("-10", lineRange{}, errInvalidLineRange)
+	testFunc("20-10", lineRange{}, errInvalidLineRange)
+	testFunc("1-2-3", lineRange{}, errInvalidLineRange)
+	testFunc("a-b", lineRange{}, errInvalidLineRange)
+}
+
+func TestCopyLines(t *testing.T) {
+	testFunc := func(data string, lr lineRange, expectData string, expectErr error) {
+		b := bytes.Buffer{}
+		err := copyLines(&b, strings.NewReader(data), lr)
+		if err != expectErr {
+			t.Errorf("Unexpected error, data: %q, range: %v, want: %v, got: %v", data, lr, expectErr, err)
+		} else if b.String() != expectData {
+			t.Errorf("Unexpected data, data: %q, range: %v, want: %q, got: %q", data, lr, expectData, b.String())
+		}
+	}
+
+	data := "1\n2\n3\n4\n5\n"
+	testFunc(data, lineRange{2, 3}, "2\n3\n", nil)
+	testFunc(data, lineRange{1, 0}, data, nil)
+	testFunc(data, lineRange{4, 0}, "4\n5\n", nil)
+	testFunc(data, lineRange{5, 10}, "5\n", nil)
+	testFunc(data, lineRange{6, 0}, "", io.EOF)
+	testFunc("1\n2", lineRange{2, 2}, "2", nil)
+	testFunc("1\n2", lineRange{3, 3}, "", io.EOF)
+	testFunc("1\n\n3\n", lineRange{2, 2}, "\n", nil)
+	testFunc("", lineRange{1, 1}, "", io.EOF)
+
+	long := strings.Repeat("x", 10000) + "\n"
+	testFunc(long+long+"end", lineRange{2, 3}, long+"end", nil)
+}
+
+func TestLineCounter(t *testing.T) {
+	testFunc := func(data string, expectLines int) {
+		c := &lineCounter{}
+		for _, b := range []byte(data) {
+			c.Write([]byte{b})
+		}
+		if c.Lines() != expectLines {
+			t.Errorf("Unexpected lines, data: %q, want: %d, got: %d", data, expectLines, c.Lines())
+		}
+	}
+
+	testFunc("", 0)
+	testFunc("a", 1)
+	testFunc("a\n", 1)
+	testFunc("a\nb", 2)
+	testFunc("\n\n", 2)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// listEntry is a file or folder in the listing
+//
+// Name and Path are in URL form, e.g. file "today" and folder "2018/", Path is relative to the listed folder
+type listEntry struct {
+	Name    string
+	Path    string
+	Type    string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+
+	// name is the storage name
+	name string
+}
+
+type listing struct {
+	Entries    []listEntry
+	NextCursor string
+}
+
+// listOptions are the query parameters of listing
+type listOptions struct {
+	recursive bool
+	glob      string
+	sortParam string
+	sort      string
+	desc      bool
+	limit     int
+	cursor    *listCursor
+}
+
+// listCursor is the sort key of the last entry of a page, the next page starts after it
+type listCursor struct {
+	Sort    string
+	Name    string
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// parseListOptions parses query parameters: recursive, glob, sort (path, name, size or mtime, "-" prefix for descending), limit and cursor
+func parseListOptions(req *http.Request) (*listOptions, error) {
+	q := req.URL.Query()
+	o := &listOptions{sort: "path", limit: defaultListLimit}
+
+	recursive, err := queryBool(req, "recursive")
+	if err != nil {
+		return nil, errors.New("invalid recursive")
+	}
+	o.recursive = recursive
+
+	o.glob = q.Get("glob")
+	if _, err := path.Match(o.glob, ""); err != nil {
+		return nil, errors.New("invalid glob")
+	}
+
+	if v := q.Get("sort"); len(v) > 0 {
+		o.sortParam = v
+		o.desc = strings.HasPrefix(v, "-")
+		o.sort = strings.TrimPrefix(v, "-")
+		switch o.sort {
+		case "path", "name", "size", "mtime":
+		default:
+			return nil, errors.New("invalid sort")
+		}
+	}
+
+	if v := q.Get("limit"); len(v) > 0 {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, errors.New("invalid limit")
+		}
+		o.limit = limit
+	}
+
+	if v := q.Get("cursor"); len(v) > 0 {
+		c, err := decodeListCursor(v)
+		// Cursor is only valid for the same order
+		if err != nil || c.Sort != o.sortParam {
+			return nil, errInvalidCursor
+		}
+		o.cursor = c
+	}
+	return o, nil
+}
+
+func (c *listCursor) encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeListCursor(s string) (*listCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	c := &listCursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, errInvalidCursor
+	}
+	return c, nil
+}
+
+// less reports whether entry a sorts before b, ties are ordered by path, so the order is total
+func (o *listOptions) less(a, b *listEntry) bool {
+	switch {
+	case o.sort == "size" && a.Size != b.Size:
+		return (a.Size < b.Size) != o.desc
+	case o.sort == "mtime" && !a.ModTime.Equal(b.ModTime):
+		return a.ModTime.Before(b.ModTime) != o.desc
+	case o.sort == "name" && a.Name != b.Name:
+		return (a.Name < b.Name) != o.desc
+	case o.sort == "path":
+		return (a.Path < b.Path) != o.desc
+	}
+	return a.Path < b.Path
+}
+
+// listFolder lists the entries of the folder matching the options, and fills ETags of files in the page from cache (nil to disable),
+// so files are only read once until they change
+func listFolder(store Storage, cache *statCache, dirname string, o *listOptions) (*listing, error) {
+	entries := make([]listEntry, 0)
+	if err := walkFolder(store, dirname, "", o.recursive, func(e listEntry) {
+		if matched, _ := path.Match(o.glob, strings.TrimSuffix(e.Name, "/")); matched || len(o.glob) <= 0 {
+			entries = append(entries, e)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return o.less(&entries[i], &entries[j])
+	})
+
+	if o.cursor != nil {
+		after := &listEntry{Name: o.cursor.Name, Path: o.cursor.Path, Size: o.cursor.Size, ModTime: o.cursor.ModTime}
+		i := sort.Search(len(entries), func(i int) bool {
+			return o.less(after, &entries[i])
+		})
+		entries = entries[i:]
+	}
+
+	l := &listing{Entries: entries}
+	if len(entries) > o.limit {
+		l.Entries = entries[:o.limit]
+		last := l.Entries[o.limit-1]
+		l.NextCursor = (&listCursor{
+			Sort:    o.sortParam,
+			Name:    last.Name,
+			Path:    last.Path,
+			Size:    last.Size,
+			ModTime: last.ModTime,
+		}).encode()
+	}
+
+	for i := range l.Entries {
+		e := &l.Entries[i]
+		if e.Type != "file" {
+			continue
+		}
+		f, _, err := fileStatOf(store, cache, e.name)
+		if os.IsNotExist(err) {
+			// Removed after listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		e.ETag = f.etag
+	}
+	return l, nil
+}
+
+// walkFolder calls fn with the entries under the folder, prefix is the path of the folder relative to the listed folder
+//
+// Only text files are listed, since other files are not reachable by the API
+func walkFolder(store Storage, dirname, prefix string, recursive bool, fn func(listEntry)) error {
+	files, err := store.List(dirname)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		e := listEntry{
+			Size:    file.Size(),
+			ModTime: file.ModTime(),
+		}
+		if file.IsDir() {
+			e.Name = file.Name() + "/"
+			e.Type = "folder"
+			e.Size = 0
+			e.name = path.Join(dirname, file.Name()) + "/"
+		} else if strings.HasSuffix(file.Name(), ".txt") {
+			e.Name = strings.TrimSuffix(file.Name(), ".txt")
+			e.Type = "file"
+			e.name = path.Join(dirname, file.Name())
+		} else {
+			continue
+		}
+		e.Path = prefix + e.Name
+		fn(e)
+
+		if recursive && file.IsDir() {
+			err := walkFolder(store, e.name, e.Path, recursive, fn)
+			if os.IsNotExist(err) {
+				// Removed after listed
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestListHandler(t *testing.T) {
+	store := NewMemoryStorage()
+	files := map[string]string{
+		"/news/today.txt":        "hello world",
+		"/news/yesterday.txt":    "hi",
+		"/news/2018/old.txt":     "old news",
+		"/news/2018/12/xmas.txt": "merry christmas",
+		"/news/readme.md":        "not a text file",
+		"/news/.hidden.txt":      "hidden",
+	}
+	for name, content := range files {
+		if err := store.Put(name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := service(store, newPathLocker(), defaultConfig())
+
+	list := func(target string, expectCode int) *listing {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s, want: %d, got: %d, body: %s", target, expectCode, w.Code, w.Body.String())
+			return nil
+		}
+		if expectCode != http.StatusOK {
+			return nil
+		}
+		l := &listing{}
+		if err := json.Unmarshal(w.Body.Bytes(), l); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	paths := func(l *listing) string {
+		ps := make([]string, 0)
+		for _, e := range l.Entries {
+			ps = append(ps, e.Path)
+		}
+		return strings.Join(ps, ",")
+	}
+	testFunc := func(target, expectPaths string) {
+		if l := list(target, http.StatusOK); l != nil && paths(l) != expectPaths {
+			t.Errorf("Unexpected entries, %s, want: %s, got: %s", target, expectPaths, paths(l))
+		}
+	}
+
+	testFunc("/news/?list", "2018/,today,yesterday")
+	testFunc("/news/?list&recursive=true", "2018/,2018/12/,2018/12/xmas,2018/old,today,yesterday")
+	testFunc("/news/?list&recursive=true&sort=name", "2018/12/,2018/,2018/old,today,2018/12/xmas,yesterday")
+	testFunc("/news/?list&recursive=true&sort=-path", "yesterday,today,2018/old,2018/12/xmas,2018/12/,2018/")
+	testFunc("/news/?list&recursive=true&glob=*day", "today,yesterday")
+	testFunc("/news/?list&recursive=true&sort=-size", "2018/12/xmas,today,2018/old,yesterday,2018/,2018/12/")
+	testFunc("/news/?list&sort=-name", "yesterday,today,2018/")
+	testFunc("/news/2018/12/?list", "xmas")
+
+	l := list("/news/?list", http.StatusOK)
+	if e := l.Entries[1]; e.Name != "today" || e.Type != "file" || e.Size != 11 || e.ETag != contentETag(([]byte)("hello world")) || e.ModTime.IsZero() {
+		t.Errorf("Unexpected file entry, %+v", e)
+	}
+	if e := l.Entries[0]; e.Name != "2018/" || e.Type != "folder" || len(e.ETag) > 0 {
+		t.Errorf("Unexpected folder entry, %+v", e)
+	}
+	if len(l.NextCursor) > 0 {
+		t.Errorf("Last page should not have cursor, got: %s", l.NextCursor)
+	}
+
+	// Pages should cover all entries exactly once, in the same order
+	for _, sort := range []string{"", "name", "-size", "mtime"} {
+		all := strings.Join(strings.Split(paths(list("/news/?list&recursive=true&sort="+sort, http.StatusOK)), ","), ",")
+		got := make([]string, 0)
+		target := "/news/?list&recursive=true&limit=2&sort=" + sort
+		for i := 0; ; i++ {
+			l := list(target, http.StatusOK)
+			if l == nil || i > 10 {
+				t.Fatalf("Pagination does not end, sort: %s", sort)
+			}
+			if len(l.Entries) > 2 {
+				t.Errorf("Page exceeds limit, got: %d", len(l.Entries))
+			}
+			got = append(got, paths(l))
+			if len(l.NextCursor) <= 0 {
+				break
+			}
+			target = "/news/?list&recursive=true&limit=2&sort=" + sort + "&cursor=" + l.NextCursor
+		}
+		if strings.Join(got, ",") != all {
+			t.Errorf("Unexpected pages, sort: %s, want: %s, got: %v", sort, all, got)
+		}
+	}
+
+	l = list("/news/?list&limit=1", http.StatusOK)
+	list("/news/?list&limit=1&sort=size&cursor="+l.NextCursor, http.StatusBadRequest)
+	list("/news/?list&cursor=xxx", http.StatusBadRequest)
+	list("/news/?list&limit=0", http.StatusBadRequest)
+	list("/news/?list&limit=abc", http.StatusBadRequest)
+	list("/news/?list&sort=color", http.StatusBadRequest)
+	list("/news/?list&glob=[", http.StatusBadRequest)
+	list("/news/?list&recursive=maybe", http.StatusBadRequest)
+	list("/none/?list", http.StatusNotFound)
+
+	// ETags are read once until files change, files written through the service are not read again
+	counting := &countingStorage{Storage: store}
+	h = service(counting, newPathLocker(), defaultConfig())
+	list("/news/?list", http.StatusOK)
+	list("/news/?list", http.StatusOK)
+	if counting.gets != 2 {
+		t.Errorf("Unexpected reads, want: 2, got: %d", counting.gets)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/news/today", strings.NewReader("changed"))
+	req.Header.Set("Content-Type", "text/plain")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	counting.gets = 0
+	l = list("/news/?list", http.StatusOK)
+	if e := l.Entries[1]; e.ETag != contentETag(([]byte)("changed")) {
+		t.Errorf("Unexpected ETag, want: %s, got: %s", contentETag(([]byte)("changed")), e.ETag)
+	}
+	if counting.gets != 0 {
+		t.Errorf("Unexpected reads, want: 0, got: %d", counting.gets)
+	}
+}
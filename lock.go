@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pathLocker is a lock manager that provides a read-write lock per storage name, it is safe for concurrent use
+//
+// Locking a name also locks its parent folders shared, so locking a folder exclusively waits for every operation under it.
+// Locks are acquired in order of names, which avoids deadlocks when locking multiple names
+type pathLocker struct {
+	mutex sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newPathLocker() *pathLocker {
+	return &pathLocker{
+		locks: map[string]*pathLock{},
+	}
+}
+
+// Lock locks the names exclusively, it returns the function to unlock them
+func (l *pathLocker) Lock(names ...string) (unlock func()) {
+	return l.lock(names, true)
+}
+
+// RLock locks the names shared, it returns the function to unlock them
+func (l *pathLocker) RLock(names ...string) (unlock func()) {
+	return l.lock(names, false)
+}
+
+func (l *pathLocker) lock(names []string, exclusive bool) func() {
+	modes := map[string]bool{}
+	for _, name := range names {
+		for _, dir := range parentFolders(name) {
+			if _, ok := modes[dir]; !ok {
+				modes[dir] = false
+			}
+		}
+		modes[name] = modes[name] || exclusive
+	}
+	keys := make([]string, 0, len(modes))
+	for k := range modes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	l.mutex.Lock()
+	locks := make([]*pathLock, len(keys))
+	for i, k := range keys {
+		lock, ok := l.locks[k]
+		if !ok {
+			lock = &pathLock{}
+			l.locks[k] = lock
+		}
+		lock.refs++
+		locks[i] = lock
+	}
+	l.mutex.Unlock()
+
+	for i, k := range keys {
+		if modes[k] {
+			locks[i].Lock()
+		} else {
+			locks[i].RLock()
+		}
+	}
+
+	return func() {
+		for i := len(keys) - 1; i >= 0; i-- {
+			if modes[keys[i]] {
+				locks[i].Unlock()
+			} else {
+				locks[i].RUnlock()
+			}
+		}
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		for i, k := range keys {
+			locks[i].refs--
+			if locks[i].refs <= 0 {
+				delete(l.locks, k)
+			}
+		}
+	}
+}
+
+// parentFolders returns the parent folder names of the storage name, e.g. "/", "/news/" for "/news/today.txt"
+func parentFolders(name string) []string {
+	dirs := make([]string, 0)
+	if name == "/" {
+		return dirs
+	}
+	for dir := path.Dir(strings.TrimSuffix(name, "/")); ; dir = path.Dir(dir) {
+		if dir == "/" {
+			dirs = append(dirs, "/")
+			break
+		}
+		dirs = append(dirs, dir+"/")
+	}
+	return dirs
+}
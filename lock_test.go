@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParentFolders(t *testing.T) {
+	testFunc := func(name string, expect []string) {
+		if dirs := parentFolders(name); !reflect.DeepEqual(dirs, expect) {
+			t.Errorf("Unexpected parent folders, name: %s, want: %v, got: %v", name, expect, dirs)
+		}
+	}
+
+	testFunc("/", []string{})
+	testFunc("/a.txt", []string{"/"})
+	testFunc("/news/", []string{"/"})
+	testFunc("/news/today.txt", []string{"/news/", "/"})
+	testFunc("/news/2018/", []string{"/news/", "/"})
+}
+
+func TestPathLocker(t *testing.T) {
+	l := newPathLocker()
+
+	// blocked returns a boolean indicating whether locking the names waits for the held lock
+	blocked := func(lock func(...string) func(), names ...string) bool {
+		done := make(chan struct{})
+		go func() {
+			lock(names...)()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return false
+		case <-time.After(50 * time.Millisecond):
+			<-done
+			return true
+		}
+	}
+
+	testFunc := func(held []string, exclusive bool, lock func(...string) func(), names []string, expectBlocked bool) {
+		var unlock func()
+		if exclusive {
+			unlock = l.Lock(held...)
+		} else {
+			unlock = l.RLock(held...)
+		}
+		unlocked := make(chan struct{})
+		time.AfterFunc(100*time.Millisecond, func() {
+			unlock()
+			close(unlocked)
+		})
+		if b := blocked(lock, names...); b != expectBlocked {
+			t.Errorf("Unexpected blocking, held: %v (exclusive: %v), names: %v, want: %v, got: %v", held, exclusive, names, expectBlocked, b)
+		}
+		<-unlocked
+	}
+
+	testFunc([]string{"/a.txt"}, true, l.Lock, []string{"/a.txt"}, true)
+	testFunc([]string{"/a.txt"}, true, l.RLock, []string{"/a.txt"}, true)
+	testFunc([]string{"/a.txt"}, false, l.RLock, []string{"/a.txt"}, false)
+	testFunc([]string{"/a.txt"}, true, l.Lock, []string{"/b.txt"}, false)
+	testFunc([]string{"/news/a.txt"}, true, l.Lock, []string{"/news/"}, true)
+	testFunc([]string{"/news/a.txt"}, true, l.Lock, []string{"/"}, true)
+	testFunc([]string{"/news/"}, true, l.Lock, []string{"/news/2018/a.txt"}, true)
+	testFunc([]string{"/news/"}, true, l.Lock, []string{"/sports/a.txt"}, false)
+	testFunc([]string{"/a.txt", "/b.txt"}, true, l.Lock, []string{"/b.txt"}, true)
+	testFunc([]string{"/news/", "/news/a.txt"}, true, l.Lock, []string{"/news/b.txt"}, true)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.locks) != 0 {
+		t.Errorf("Locks should be released, got: %d", len(l.locks))
+	}
+}
+
+func TestPathLockerNoDeadlock(t *testing.T) {
+	l := newPathLocker()
+	names := [][]string{
+		{"/a.txt", "/b.txt"},
+		{"/b.txt", "/a.txt"},
+		{"/news/"},
+		{"/news/a.txt", "/a.txt"},
+		{"/news/2018/a.txt"},
+		{"/"},
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				n := names[(i+j)%len(names)]
+				if j%3 == 0 {
+					l.RLock(n...)()
+				} else {
+					l.Lock(n...)()
+				}
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Deadlock")
+	}
+}
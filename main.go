@@ -1,17 +1,68 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"net/http"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	// TODO: Get arguments from os.Environ or os.Args
-	port := "8080"
-	fileDir := "./files"
+	conf, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		os.Exit(2)
+	}
 
-	h := service(fileDir)
-	fmt.Fprintf(os.Stdout, "Listening :%v...\n", port)
-	http.ListenAndServe(":"+port, h)
+	if conf.PrintConfig {
+		if err := conf.print(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Print config failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	store := conf.newStorage()
+	locks := newPathLocker()
+	srv := newServer(conf, service(store, locks, conf))
+	if srv.TLSConfig, err = newTLSConfig(conf); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid TLS config: %v\n", err)
+		os.Exit(2)
+	}
+	l, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Listen failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	scheme := "http"
+	if srv.TLSConfig != nil {
+		scheme = "https"
+	}
+	stopSweepers := make(chan struct{})
+	defer close(stopSweepers)
+	if conf.Trash && conf.TrashRetention > 0 {
+		go runSweeper("items in trash", conf.TrashRetention, sweepInterval, stopSweepers, func(before time.Time) (int, error) {
+			return sweepTrash(store, locks, before)
+		})
+	}
+	if conf.Versions && conf.VersionRetention > 0 {
+		go runSweeper("revisions", conf.VersionRetention, sweepInterval, stopSweepers, func(before time.Time) (int, error) {
+			return sweepVersions(store, locks, versionsFolder, before)
+		})
+	}
+
+	fmt.Fprintf(os.Stdout, "Listening %v://%v...\n", scheme, l.Addr())
+	if err := serve(srv, l, stop, conf.ShutdownTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Server stopped: %v\n", err)
+		os.Exit(1)
+	}
 }
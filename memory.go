@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemoryStorage returns a new Storage that keeps files in memory, it is safe for concurrent use
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		files: map[string]*memoryFile{},
+		dirs:  map[string]time.Time{"/": time.Now()},
+	}
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memoryStorage struct {
+	mutex sync.RWMutex
+	files map[string]*memoryFile
+	dirs  map[string]time.Time
+}
+
+// memoryReader implements File for memoryStorage
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (r memoryReader) Close() error { return nil }
+
+// memoryFileInfo implements os.FileInfo for memoryStorage
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memoryFileInfo) Name() string       { return i.name }
+func (i *memoryFileInfo) Size() int64        { return i.size }
+func (i *memoryFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memoryFileInfo) IsDir() bool        { return i.dir }
+func (i *memoryFileInfo) Sys() interface{}   { return nil }
+
+func (i *memoryFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | os.ModePerm
+	}
+	return os.ModePerm
+}
+
+// clean converts the storage name to the key of maps
+func (s *memoryStorage) clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (s *memoryStorage) stat(name string) (os.FileInfo, bool) {
+	if f, ok := s.files[name]; ok {
+		return &memoryFileInfo{path.Base(name), int64(len(f.data)), f.modTime, false}, true
+	}
+	if modTime, ok := s.dirs[name]; ok {
+		return &memoryFileInfo{path.Base(name), 0, modTime, true}, true
+	}
+	return nil, false
+}
+
+func (s *memoryStorage) Stat(name string) (os.FileInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	info, ok := s.stat(s.clean(name))
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return info, nil
+}
+
+func (s *memoryStorage) Get(name string) (File, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key := s.clean(name)
+	f, ok := s.files[key]
+	if !ok {
+		if _, ok := s.dirs[key]; ok {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	// data is never modified after stored, no need to copy
+	return memoryReader{bytes.NewReader(f.data)}, nil
+}
+
+func (s *memoryStorage) Put(name string, r io.Reader) error {
+	// Read before lock, so a slow reader does not block others
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := s.clean(name)
+	if _, ok := s.dirs[key]; ok {
+		return &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+
+	if err := s.mkdirAll(path.Dir(key)); err != nil {
+		return err
+	}
+
+	s.files[key] = &memoryFile{
+		data:    data,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// mkdirAll creates the folder and its parent folders, it fails if any of them is a file
+func (s *memoryStorage) mkdirAll(dir string) error {
+	for d := dir; ; d = path.Dir(d) {
+		if _, ok := s.files[d]; ok {
+			return &os.PathError{Op: "mkdir", Path: d, Err: errors.New("not a directory")}
+		}
+		if d == "/" {
+			break
+		}
+	}
+	now := time.Now()
+	for d := dir; d != "/"; d = path.Dir(d) {
+		if _, ok := s.dirs[d]; ok {
+			break
+		}
+		s.dirs[d] = now
+	}
+	return nil
+}
+
+func (s *memoryStorage) Delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := s.clean(name)
+	if _, ok := s.files[key]; ok {
+		delete(s.files, key)
+		return nil
+	}
+	if _, ok := s.dirs[key]; !ok || key == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(s.children(key)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(s.dirs, key)
+	return nil
+}
+
+func (s *memoryStorage) Move(oldName, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	oldKey, newKey := s.clean(oldName), s.clean(newName)
+	info, ok := s.stat(oldKey)
+	if !ok || oldKey == "/" {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if newInfo, ok := s.stat(newKey); ok && (info.IsDir() || newInfo.IsDir()) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrExist}
+	}
+	if info.IsDir() && strings.HasPrefix(newKey+"/", oldKey+"/") {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errors.New("destination is inside source")}
+	}
+	if err := s.mkdirAll(path.Dir(newKey)); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		s.files[newKey] = s.files[oldKey]
+		delete(s.files, oldKey)
+		return nil
+	}
+
+	// Move the folder and everything under it
+	prefix := oldKey + "/"
+	for k, f := range s.files {
+		if strings.HasPrefix(k, prefix) {
+			s.files[newKey+"/"+k[len(prefix):]] = f
+			delete(s.files, k)
+		}
+	}
+	for k, modTime := range s.dirs {
+		if k == oldKey || strings.HasPrefix(k, prefix) {
+			s.dirs[newKey+k[len(oldKey):]] = modTime
+			delete(s.dirs, k)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) List(name string) ([]os.FileInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key := s.clean(name)
+	if _, ok := s.dirs[key]; !ok {
+		if _, ok := s.files[key]; ok {
+			return nil, &os.PathError{Op: "readdirent", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	names := s.children(key)
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, n := range names {
+		if isHiddenName(path.Base(n)) {
+			continue
+		}
+		info, _ := s.stat(n)
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// children returns the keys of files and folders directly under the folder
+func (s *memoryStorage) children(dir string) []string {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	names := make([]string, 0)
+	isChild := func(n string) bool {
+		return n != dir && strings.HasPrefix(n, prefix) && !strings.Contains(n[len(prefix):], "/")
+	}
+	for n := range s.files {
+		if isChild(n) {
+			names = append(names, n)
+		}
+	}
+	for n := range s.dirs {
+		if isChild(n) {
+			names = append(names, n)
+		}
+	}
+	return names
+}
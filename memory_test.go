@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestMemoryStorageConcurrency(t *testing.T) {
+	s := NewMemoryStorage()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("/news/%d/file.txt", i)
+			for j := 0; j < 100; j++ {
+				if err := s.Put(name, strings.NewReader("hello")); err != nil {
+					t.Error(err)
+					return
+				}
+				if f, err := s.Get(name); err != nil {
+					t.Error(err)
+					return
+				} else if b, _ := ioutil.ReadAll(f); string(b) != "hello" {
+					t.Errorf("Content is not same, want: hello, got: %s", b)
+				}
+				if _, err := s.List("/news/"); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if files, err := s.List("/news/"); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 8 {
+		t.Errorf("Unexpected number of entries, want: 8, got: %d", len(files))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	textContentType   = "text/plain; charset=utf-8"
+	binaryContentType = "application/octet-stream"
+)
+
+// contentMediaTypes are media types of file content, in order of preference
+var contentMediaTypes = []string{
+	"application/json",
+	"text/plain",
+	"application/octet-stream",
+}
+
+// requestMediaType returns the media type of request content-type, and a boolean indicating whether it is supported
+//
+// Supported are application/json with charset utf-8 (the JSON envelope), text/plain with optional charset utf-8 or us-ascii,
+// and application/octet-stream
+func requestMediaType(req *http.Request) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("CONTENT-TYPE"))
+	if err != nil {
+		return "", false
+	}
+
+	charset, hasCharset := params["charset"]
+	switch mediaType {
+	case "application/json":
+		return mediaType, hasCharset && charset == "utf-8"
+	case "text/plain":
+		charset = strings.ToLower(charset)
+		return mediaType, !hasCharset || charset == "utf-8" || charset == "us-ascii"
+	case "application/octet-stream":
+		return mediaType, true
+	}
+	return mediaType, false
+}
+
+// acceptRange is a media range in Accept header
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses Accept header to media ranges, sorted by quality
+func parseAccept(header string) []acceptRange {
+	ranges := make([]acceptRange, 0)
+	for _, v := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// match returns a boolean indicating whether the media range matches the media type, and the specificity of the range
+func (r acceptRange) match(mediaType string) (bool, int) {
+	if r.mediaType == mediaType {
+		return true, 2
+	}
+	if r.mediaType == "*/*" {
+		return true, 0
+	}
+	if strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(r.mediaType, "*")) {
+		return true, 1
+	}
+	return false, 0
+}
+
+// negotiate returns the offered media type that Accept header prefers, offers are in order of server preference
+//
+// If Accept header is absent, the first offer is returned. If nothing is acceptable, it returns empty string
+func negotiate(header string, offers []string) string {
+	if len(strings.TrimSpace(header)) <= 0 {
+		return offers[0]
+	}
+
+	ranges := parseAccept(header)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		// The most specific range decides the quality of the offer
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			if ok, s := r.match(offer); ok && s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestMediaType(t *testing.T) {
+	testFunc := func(contentType, expectMediaType string, expectOK bool) {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("CONTENT-TYPE", contentType)
+		mediaType, ok := requestMediaType(req)
+		if ok != expectOK || ok && mediaType != expectMediaType {
+			t.Errorf("Unexpected result, content-type: %s, want: %s %v, got: %s %v", contentType, expectMediaType, expectOK, mediaType, ok)
+		}
+	}
+
+	testFunc(jsonContentType, "application/json", true)
+	testFunc("application/json", "", false)
+	testFunc("application/json; charset=latin1", "", false)
+	testFunc(textContentType, "text/plain", true)
+	testFunc("text/plain", "text/plain", true)
+	testFunc("text/plain; charset=UTF-8", "text/plain", true)
+	testFunc("text/plain; charset=us-ascii", "text/plain", true)
+	testFunc("text/plain; charset=big5", "", false)
+	testFunc("Text/Plain", "text/plain", true)
+	testFunc(binaryContentType, "application/octet-stream", true)
+	testFunc("text/html", "", false)
+	testFunc("", "", false)
+	testFunc("text/plain; charset", "", false)
+}
+
+func TestNegotiate(t *testing.T) {
+	testFunc := func(accept, expect string) {
+		if m := negotiate(accept, contentMediaTypes); m != expect {
+			t.Errorf("Unexpected media type, accept: %s, want: %s, got: %s", accept, expect, m)
+		}
+	}
+
+	testFunc("", "application/json")
+	testFunc("*/*", "application/json")
+	testFunc("application/json", "application/json")
+	testFunc("text/plain", "text/plain")
+	testFunc("text/*", "text/plain")
+	testFunc("application/octet-stream", "application/octet-stream")
+	testFunc("application/*", "application/json")
+	testFunc("text/html, text/plain;q=0.9, */*;q=0.1", "text/plain")
+	testFunc("application/json;q=0.5, text/plain", "text/plain")
+	testFunc("*/*;q=0.8, application/json;q=0", "text/plain")
+	testFunc("text/*, text/plain;q=0", "")
+	testFunc("application/json;q=0.5, application/octet-stream;q=0.9", "application/octet-stream")
+	testFunc("text/html", "")
+	testFunc("text/plain;q=abc", "")
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var errPatchConflict = errors.New("patch does not apply")
+
+// invalidPatchError describes why the patch is malformed
+type invalidPatchError string
+
+func (e invalidPatchError) Error() string {
+	return "invalid patch, " + string(e)
+}
+
+// patchBody is the request body of PATCH
+//
+// Op is one of:
+//   - append: appends Content to the end of the file
+//   - insert: inserts Content before Line, Line is 1-based, the line after the last line inserts at the end
+//   - replace: replaces Lines (e.g. "100-200") with Content, empty Content removes the lines
+//   - diff: applies the unified diff in Content
+type patchBody struct {
+	Op      string
+	Line    int
+	Lines   string
+	Content string
+}
+
+// patch is a validated patchBody, which can be applied to the file content
+type patch struct {
+	op      string
+	lines   lineRange
+	content string
+	hunks   []hunk
+}
+
+// newPatch validates the patchBody, it returns invalidPatchError if the patch is malformed
+func newPatch(b *patchBody) (*patch, error) {
+	p := &patch{op: b.Op, content: b.Content}
+	switch b.Op {
+	case "append":
+		if len(b.Content) <= 0 {
+			return nil, invalidPatch("no content")
+		}
+	case "insert":
+		if b.Line < 1 {
+			return nil, invalidPatch("invalid line")
+		} else if len(b.Content) <= 0 {
+			return nil, invalidPatch("no content")
+		}
+		// Insertion is a replacement of no lines
+		p.lines = lineRange{b.Line, b.Line - 1}
+	case "replace":
+		lr, err := parseLineRange(b.Lines)
+		if err != nil || lr.last <= 0 {
+			return nil, invalidPatch("invalid lines")
+		}
+		p.lines = lr
+	case "diff":
+		hunks, err := parseUnifiedDiff(b.Content)
+		if err != nil {
+			return nil, err
+		}
+		p.hunks = hunks
+	default:
+		return nil, invalidPatch("unknown op: %s", b.Op)
+	}
+	return p, nil
+}
+
+// apply writes the patched content of r to w, it returns errPatchConflict if the patch does not apply to the content
+func (p *patch) apply(w io.Writer, r io.Reader) error {
+	switch p.op {
+	case "append":
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, p.content)
+		return err
+	case "diff":
+		return applyDiff(w, r, p.hunks)
+	}
+	return replaceLines(w, r, p.lines, p.content)
+}
+
+// replaceLines writes the content of r to w with lines in lr replaced by content
+//
+// Content is treated as lines, "\n" is added if it does not end with one and more lines follow.
+// lr.last can be lr.first-1 to insert without replacing
+func replaceLines(w io.Writer, r io.Reader, lr lineRange, content string) error {
+	br := bufio.NewReader(r)
+	newline := true
+	for line := 1; line < lr.first; line++ {
+		nl, err := copyLine(w, br)
+		if err == io.EOF {
+			return errPatchConflict
+		} else if err != nil {
+			return err
+		}
+		newline = nl
+	}
+	for line := lr.first; line <= lr.last; line++ {
+		if _, err := copyLine(ioutil.Discard, br); err == io.EOF {
+			return errPatchConflict
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(content) > 0 {
+		// The last line of the file has no "\n", only when inserting at the end
+		if !newline {
+			content = "\n" + content
+		}
+		if _, err := br.Peek(1); err == nil && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(w, br)
+	return err
+}
+
+// hunk is a hunk of unified diff
+type hunk struct {
+	oldStart int
+	oldLines int
+	lines    []diffLine
+}
+
+// diffLine is a line of hunk, op is ' ' (context), '-' (removed) or '+' (added)
+type diffLine struct {
+	op      byte
+	text    string
+	newline bool
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parseUnifiedDiff parses the hunks of unified diff of a single file, header lines before the first hunk are ignored
+func parseUnifiedDiff(diff string) ([]hunk, error) {
+	lines := strings.SplitAfter(diff, "\n")
+	if len(lines[len(lines)-1]) <= 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	hunks := make([]hunk, 0)
+	headers := 0
+	next := 1
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\n")
+		m := hunkHeader.FindStringSubmatch(line)
+		if m == nil {
+			if strings.HasPrefix(line, "--- ") {
+				headers++
+			}
+			// Header lines are only allowed before the first hunk, and diff of multiple files is not supported
+			if len(hunks) > 0 || headers > 1 {
+				return nil, invalidPatch("unexpected line %d", i+1)
+			}
+			continue
+		}
+
+		h := hunk{}
+		h.oldStart, _ = strconv.Atoi(m[1])
+		h.oldLines = diffCount(m[2])
+		newLines := diffCount(m[4])
+		if h.oldLines < 0 || newLines < 0 {
+			return nil, invalidPatch("invalid hunk header at line %d", i+1)
+		}
+		start := h.oldStart
+		if h.oldLines == 0 {
+			// Insertion applies after the line
+			start++
+		}
+		if start < next {
+			return nil, invalidPatch("hunks overlap or are out of order at line %d", i+1)
+		}
+		next = start + h.oldLines
+
+		oldCount, newCount := 0, 0
+		for oldCount < h.oldLines || newCount < newLines {
+			i++
+			if i >= len(lines) {
+				return nil, invalidPatch("hunk is truncated")
+			}
+			l := diffLine{newline: strings.HasSuffix(lines[i], "\n")}
+			text := strings.TrimSuffix(lines[i], "\n")
+			if len(text) <= 0 {
+				// Some tools strip the space of empty context lines
+				text = " "
+			}
+			l.op, l.text = text[0], text[1:]
+			switch l.op {
+			case ' ':
+				oldCount++
+				newCount++
+			case '-':
+				oldCount++
+			case '+':
+				newCount++
+			case '\\':
+				if len(h.lines) <= 0 {
+					return nil, invalidPatch("unexpected line %d", i+1)
+				}
+				h.lines[len(h.lines)-1].newline = false
+				continue
+			default:
+				return nil, invalidPatch("unexpected line %d", i+1)
+			}
+			if oldCount > h.oldLines || newCount > newLines {
+				return nil, invalidPatch("hunk does not match its header at line %d", i+1)
+			}
+			h.lines = append(h.lines, l)
+		}
+		// "\ No newline at end of file" of the last line
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\\") {
+			i++
+			h.lines[len(h.lines)-1].newline = false
+		}
+		hunks = append(hunks, h)
+	}
+
+	if len(hunks) <= 0 {
+		return nil, invalidPatch("no hunks")
+	}
+	return hunks, nil
+}
+
+// diffCount parses the line count of hunk header, which is 1 if omitted
+func diffCount(s string) int {
+	if len(s) <= 0 {
+		return 1
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// invalidPatch returns the invalidPatchError of the formatted reason
+func invalidPatch(format string, a ...interface{}) error {
+	return invalidPatchError(fmt.Sprintf(format, a...))
+}
+
+// applyDiff writes the content of r with the hunks applied to w, context and removed lines should match exactly
+func applyDiff(w io.Writer, r io.Reader, hunks []hunk) error {
+	br := bufio.NewReader(r)
+	line := 1
+	for _, h := range hunks {
+		start := h.oldStart
+		if h.oldLines == 0 {
+			start++
+		}
+		for ; line < start; line++ {
+			if _, err := copyLine(w, br); err == io.EOF {
+				return errPatchConflict
+			} else if err != nil {
+				return err
+			}
+		}
+
+		for _, l := range h.lines {
+			if l.op == '+' {
+				text := l.text
+				if l.newline {
+					text += "\n"
+				}
+				if _, err := io.WriteString(w, text); err != nil {
+					return err
+				}
+				continue
+			}
+
+			old, err := readLine(br)
+			if err == io.EOF {
+				return errPatchConflict
+			} else if err != nil {
+				return err
+			}
+			line++
+			if strings.TrimSuffix(old, "\n") != l.text || strings.HasSuffix(old, "\n") != l.newline {
+				return errPatchConflict
+			}
+			if l.op == ' ' {
+				if _, err := io.WriteString(w, old); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err := io.Copy(w, br)
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewPatch(t *testing.T) {
+	testFunc := func(b patchBody, expectValid bool) {
+		_, err := newPatch(&b)
+		if _, ok := err.(invalidPatchError); (err == nil) != expectValid || err != nil && !ok {
+			t.Errorf("Unexpected result, patch: %+v, expect valid: %v, got: %v", b, expectValid, err)
+		}
+	}
+
+	testFunc(patchBody{Op: "append", Content: "hello"}, true)
+	testFunc(patchBody{Op: "append"}, false)
+	testFunc(patchBody{Op: "insert", Line: 1, Content: "hello"}, true)
+	testFunc(patchBody{Op: "insert", Line: 0, Content: "hello"}, false)
+	testFunc(patchBody{Op: "insert", Line: 1}, false)
+	testFunc(patchBody{Op: "replace", Lines: "1-2", Content: "hello"}, true)
+	testFunc(patchBody{Op: "replace", Lines: "3"}, true)
+	testFunc(patchBody{Op: "replace", Lines: "3-"}, false)
+	testFunc(patchBody{Op: "replace", Lines: "x"}, false)
+	testFunc(patchBody{Op: "diff", Content: "@@ -1 +1 @@\n-a\n+b\n"}, true)
+	testFunc(patchBody{Op: "diff", Content: "hello"}, false)
+	testFunc(patchBody{Op: "truncate"}, false)
+	testFunc(patchBody{}, false)
+}
+
+func TestPatchApply(t *testing.T) {
+	testFunc := func(data string, b patchBody, expectData string, expectErr error) {
+		p, err := newPatch(&b)
+		if err != nil {
+			t.Fatalf("Invalid patch, %+v, %v", b, err)
+		}
+		w := bytes.Buffer{}
+		err = p.apply(&w, strings.NewReader(data))
+		if err != expectErr {
+			t.Errorf("Unexpected error, data: %q, patch: %+v, want: %v, got: %v", data, b, expectErr, err)
+		} else if err == nil && w.String() != expectData {
+			t.Errorf("Unexpected data, data: %q, patch: %+v, want: %q, got: %q", data, b, expectData, w.String())
+		}
+	}
+
+	data := "1\n2\n3\n"
+	testFunc(data, patchBody{Op: "append", Content: "4\n"}, "1\n2\n3\n4\n", nil)
+	testFunc("1", patchBody{Op: "append", Content: "23"}, "123", nil)
+
+	testFunc(data, patchBody{Op: "insert", Line: 1, Content: "0"}, "0\n1\n2\n3\n", nil)
+	testFunc(data, patchBody{Op: "insert", Line: 3, Content: "a\nb\n"}, "1\n2\na\nb\n3\n", nil)
+	testFunc(data, patchBody{Op: "insert", Line: 4, Content: "4"}, "1\n2\n3\n4", nil)
+	testFunc("1\n2", patchBody{Op: "insert", Line: 3, Content: "3"}, "1\n2\n3", nil)
+	testFunc(data, patchBody{Op: "insert", Line: 5, Content: "5"}, "", errPatchConflict)
+
+	testFunc(data, patchBody{Op: "replace", Lines: "2", Content: "two"}, "1\ntwo\n3\n", nil)
+	testFunc(data, patchBody{Op: "replace", Lines: "1-2", Content: "a\nb\nc\n"}, "a\nb\nc\n3\n", nil)
+	testFunc(data, patchBody{Op: "replace", Lines: "2-3"}, "1\n", nil)
+	testFunc(data, patchBody{Op: "replace", Lines: "3", Content: "three"}, "1\n2\nthree", nil)
+	testFunc(data, patchBody{Op: "replace", Lines: "3-4", Content: "x"}, "", errPatchConflict)
+
+	diff := `--- a/today.txt
++++ b/today.txt
+@@ -1,3 +1,3 @@
+ 1
+-2
++two
+ 3
+`
+	testFunc(data, patchBody{Op: "diff", Content: diff}, "1\ntwo\n3\n", nil)
+	testFunc("1\n2\n3\n4\n", patchBody{Op: "diff", Content: diff}, "1\ntwo\n3\n4\n", nil)
+	testFunc("1\n3\n3\n", patchBody{Op: "diff", Content: diff}, "", errPatchConflict)
+	testFunc("1\n2\n", patchBody{Op: "diff", Content: diff}, "", errPatchConflict)
+
+	diff = `@@ -0,0 +1 @@
++0
+@@ -2,0 +4,2 @@
++2.1
++2.2
+@@ -3 +5 @@
+-3
++3
+\ No newline at end of file
+`
+	testFunc(data, patchBody{Op: "diff", Content: diff}, "0\n1\n2\n2.1\n2.2\n3", nil)
+	testFunc("1\n2\n3", patchBody{Op: "diff", Content: diff}, "", errPatchConflict)
+}
+
+func TestParseUnifiedDiff(t *testing.T) {
+	testFunc := func(diff string, expectHunks int) {
+		hunks, err := parseUnifiedDiff(diff)
+		if expectHunks < 0 {
+			if _, ok := err.(invalidPatchError); !ok {
+				t.Errorf("Should be invalid, diff: %q, got: %v", diff, err)
+			}
+			return
+		}
+		if err != nil || len(hunks) != expectHunks {
+			t.Errorf("Unexpected hunks, diff: %q, want: %d, got: %d, %v", diff, expectHunks, len(hunks), err)
+		}
+	}
+
+	testFunc("diff --git a/a.txt b/a.txt\nindex 1..2 100644\n--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n", 1)
+	testFunc("@@ -1 +1 @@\n-a\n+b\n@@ -5 +5 @@\n-e\n+f", 2)
+	testFunc("@@ -1,2 +1,2 @@\n a\n\n", 1)
+	testFunc("", -1)
+	testFunc("--- a\n+++ b\n", -1)
+	testFunc("@@ -1,2 +1,2 @@\n a\n", -1)
+	testFunc("@@ -1 +1 @@\n-a\n+b\n+c\n", -1)
+	testFunc("@@ -1 +1 @@\n*a\n", -1)
+	testFunc("@@ -5 +5 @@\n-e\n+f\n@@ -1 +1 @@\n-a\n+b\n", -1)
+	testFunc("@@ -1 +1 @@\n-a\n+b\n--- a\n+++ b\n@@ -1 +1 @@\n-a\n+b\n", -1)
+}
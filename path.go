@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errInvalidPath   = errors.New("invalid path")
+	errForbiddenPath = errors.New("forbidden path")
+
+	errDanglingSymlink = errors.New("dangling symbolic link")
+)
+
+// resolveName converts the URL path (with path prefix stripped) to storage name
+//
+// Files are mapped to "/<path>.txt" and folders (path ends with "/") to "/<path>/".
+// It returns errInvalidPath for malformed paths (NUL bytes, control characters, backslashes, volume names, "." or ".." segments),
+// and errForbiddenPath for hidden names (starting with "."), which are reserved by the service
+func resolveName(urlPath string) (string, error) {
+	for _, c := range urlPath {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return "", errInvalidPath
+		}
+	}
+
+	for _, seg := range strings.Split(urlPath, "/") {
+		switch {
+		case seg == "." || seg == "..":
+			return "", errInvalidPath
+		case len(filepath.VolumeName(seg)) > 0:
+			return "", errInvalidPath
+		case isHiddenName(seg):
+			return "", errForbiddenPath
+		}
+	}
+
+	name := path.Join("/", urlPath)
+	if !strings.HasSuffix(urlPath, "/") && len(urlPath) > 0 {
+		name += ".txt"
+	} else if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return name, nil
+}
+
+// isHiddenName returns a boolean indicating whether the file or folder name is hidden, which is reserved by the service (e.g. temporary files)
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// isForbiddenPath returns a boolean indicating whether the error is known to report that the path is forbidden
+func isForbiddenPath(err error) bool {
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+	return err == errForbiddenPath
+}
+
+// isWithin returns a boolean indicating whether the physical path p is root or under root
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// realPath returns the physical path p with symbolic links evaluated
+//
+// Paths that do not exist yet are evaluated by their deepest existing parent folder.
+// If a symbolic link in the path points to nothing, it returns errDanglingSymlink
+func realPath(p string) (string, error) {
+	real, rest := p, ""
+	for {
+		r, err := filepath.EvalSymlinks(real)
+		if err == nil {
+			return filepath.Join(r, rest), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		} else if _, err := os.Lstat(real); err == nil {
+			return "", errDanglingSymlink
+		}
+
+		parent := filepath.Dir(real)
+		if parent == real {
+			return p, nil
+		}
+		rest = filepath.Join(filepath.Base(real), rest)
+		real = parent
+	}
+}
@@ -15,7 +15,7 @@ type WordReader interface {
 func NewWordReader(r io.Reader) WordReader {
 	return &wordReader{
 		reader: r,
-		rbuf:   make([]byte, 1024),
+		rbuf:   make([]byte, 0, 1024),
 	}
 }
 
@@ -54,7 +54,13 @@ func (r *wordReader) Read() (string, error) {
 			}
 		}
 
-		_, err := r.reader.Read(r.rbuf)
+		// Process the n bytes read before considering the error
+		n, err := r.reader.Read(r.rbuf[:cap(r.rbuf)])
+		r.rbuf = r.rbuf[:n]
+		r.pos = 0
+		if n > 0 {
+			continue
+		}
 		if err == io.EOF {
 			if len(r.wbuf) > 0 {
 				w := string(r.wbuf)
@@ -65,6 +71,5 @@ func (r *wordReader) Read() (string, error) {
 		} else if err != nil {
 			panic(err)
 		}
-		r.pos = 0
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestWordReader(t *testing.T) {
@@ -35,3 +36,25 @@ world 10 apple sc__y
 	checkErr(io.EOF)
 	checkErr(io.EOF)
 }
+
+func TestWordReaderPartialRead(t *testing.T) {
+	text := bytes.Repeat(([]byte)("hello world "), 200)
+	r := NewWordReader(iotest.HalfReader(bytes.NewReader(text)))
+
+	n := 0
+	for {
+		s, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if s != "hello" && s != "world" {
+			t.Errorf("Unexpected word, got: %s", s)
+		}
+		n++
+	}
+	if n != 400 {
+		t.Errorf("Unexpected word count, want: 400, got: %d", n)
+	}
+}
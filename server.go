@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newServer returns a new http.Server with timeouts from the config
+func newServer(conf *config, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         conf.Addr,
+		Handler:      h,
+		ReadTimeout:  conf.ReadTimeout,
+		WriteTimeout: conf.WriteTimeout,
+		IdleTimeout:  conf.IdleTimeout,
+	}
+}
+
+// serve accepts connections on l (with TLS if srv.TLSConfig is set) until a signal is received from stop, then shuts down the server gracefully
+//
+// In-flight requests are waited up to shutdownTimeout, after that the remaining connections are closed and an error is returned
+func serve(srv *http.Server, l net.Listener, stop <-chan os.Signal, shutdownTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(l, "", "")
+		} else {
+			errc <- srv.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		fmt.Fprintf(os.Stdout, "Received %v, shutting down...\n", sig)
+	}
+
+	ctx := context.Background()
+	if shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
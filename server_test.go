@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeGracefulShutdown(t *testing.T) {
+	testFunc := func(handlerDelay, shutdownTimeout time.Duration, expectErr bool) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		started := make(chan struct{})
+		srv := newServer(defaultConfig(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			time.Sleep(handlerDelay)
+			w.Write(([]byte)("done"))
+		}))
+
+		stop := make(chan os.Signal, 1)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- serve(srv, l, stop, shutdownTimeout)
+		}()
+
+		type result struct {
+			body string
+			err  error
+		}
+		resc := make(chan result, 1)
+		go func() {
+			resp, err := http.Get("http://" + l.Addr().String() + "/")
+			if err != nil {
+				resc <- result{"", err}
+				return
+			}
+			defer resp.Body.Close()
+			b, err := ioutil.ReadAll(resp.Body)
+			resc <- result{string(b), err}
+		}()
+
+		<-started
+		stop <- syscall.SIGTERM
+
+		err = <-errc
+		if (err != nil) != expectErr {
+			t.Errorf("Unexpected serve error, delay: %v, timeout: %v, got: %v", handlerDelay, shutdownTimeout, err)
+		}
+
+		res := <-resc
+		if !expectErr && (res.err != nil || res.body != "done") {
+			t.Errorf("In-flight request should be finished, body: %s, err: %v", res.body, res.err)
+		}
+	}
+
+	testFunc(100*time.Millisecond, time.Second, false)
+	testFunc(time.Second, 100*time.Millisecond, true)
+}
+
+func TestServeListenerError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	if err := serve(newServer(defaultConfig(), http.NotFoundHandler()), l, make(chan os.Signal), time.Second); err == nil {
+		t.Errorf("Serve on closed listener should fail")
+	}
+}
@@ -2,31 +2,90 @@ package main
 
 import (
 	"net/http"
+	"path"
 	"strings"
 
 	"github.com/gorilla/mux"
 )
 
-func service(fileDir string) http.Handler {
-	const pathPrefix = "/"
+// service returns the handler of files in store, locks must be shared by everything else that writes store, e.g. sweepers
+func service(store Storage, locks *pathLocker, conf *config) http.Handler {
+	// The prefix ends with "/", so it only matches whole path segments, e.g. "/api" does not match "/apinews"
+	pathPrefix := strings.TrimSuffix(conf.PathPrefix, "/") + "/"
+	cache := newStatCache()
+	store = cache.wrap(store)
+	versions := conf.versionPolicy()
 
 	r := mux.NewRouter()
-	r.PathPrefix(pathPrefix).Handler(func() http.Handler {
-		dir := dirHandler(fileDir, pathPrefix)
-		file := retrieveFileHandler(fileDir, pathPrefix)
+
+	// Trash is reserved, so its routes are matched before files
+	trashPath := path.Join(pathPrefix, trashFolder) + "/"
+	r.Path(trashPath).Handler(listTrashHandler(store)).Methods(http.MethodGet)
+	r.Path(trashPath).Handler(purgeTrashHandler(store, locks)).Methods(http.MethodDelete)
+	r.Path(trashPath + "{id}").Handler(trashItemHandler(store)).Methods(http.MethodGet)
+	r.Path(trashPath + "{id}").Handler(purgeTrashHandler(store, locks)).Methods(http.MethodDelete)
+	r.Path(trashPath + "{id}/restore").Handler(restoreTrashHandler(store, locks)).Methods(http.MethodPost)
+
+	get := func() http.Handler {
+		dir := dirHandler(store, cache, pathPrefix, conf.StatsWorkers)
+		list := listHandler(store, cache, pathPrefix)
+		file := retrieveFileHandler(store, locks, cache, pathPrefix)
+		revisions := versionsHandler(store, locks, pathPrefix)
+		fileStats := fileStatsHandler(store, pathPrefix)
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			q := req.URL.Query()
 			if strings.HasSuffix(req.URL.Path, "/") || len(req.URL.Path) <= 0 {
+				if _, ok := q["list"]; ok {
+					list.ServeHTTP(w, req)
+					return
+				}
 				dir.ServeHTTP(w, req)
 				return
 			}
+			if _, ok := q["stats"]; ok {
+				fileStats.ServeHTTP(w, req)
+				return
+			}
+			for _, key := range []string{"versions", "version", "diff"} {
+				if _, ok := q[key]; ok {
+					revisions.ServeHTTP(w, req)
+					return
+				}
+			}
+			file.ServeHTTP(w, req)
+		})
+	}()
+	r.PathPrefix(pathPrefix).Handler(get).Methods(http.MethodGet)
+	r.PathPrefix(pathPrefix).Handler(headMiddleware(get)).Methods(http.MethodHead)
+	r.PathPrefix(pathPrefix).Handler(optionsHandler(store, pathPrefix)).Methods(http.MethodOptions)
+	r.PathPrefix(pathPrefix).Handler(func() http.Handler {
+		modify := modifyFileHandler(store, locks, pathPrefix, versions)
+		rollback := rollbackHandler(store, locks, pathPrefix, versions)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if _, ok := req.URL.Query()["rollback"]; ok {
+				rollback.ServeHTTP(w, req)
+				return
+			}
+			modify.ServeHTTP(w, req)
+		})
+	}()).Methods(http.MethodPut)
+	r.PathPrefix(pathPrefix).Handler(patchFileHandler(store, locks, pathPrefix, versions)).Methods(http.MethodPatch)
+	r.PathPrefix(pathPrefix).Handler(createFileHandler(store, locks, pathPrefix)).Methods(http.MethodPost)
+	r.PathPrefix(pathPrefix).Handler(func() http.Handler {
+		folder := removeFolderHandler(store, locks, pathPrefix, conf.Trash)
+		file := removeFileHandler(store, locks, pathPrefix, conf.Trash)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if strings.HasSuffix(req.URL.Path, "/") || len(req.URL.Path) <= 0 {
+				folder.ServeHTTP(w, req)
+				return
+			}
 			file.ServeHTTP(w, req)
 		})
-	}()).Methods(http.MethodGet)
-	r.PathPrefix(pathPrefix).Handler(modifyFileHandler(fileDir, pathPrefix)).Methods(http.MethodPut)
-	r.PathPrefix(pathPrefix).Handler(createFileHandler(fileDir, pathPrefix)).Methods(http.MethodPost)
-	r.PathPrefix(pathPrefix).Handler(removeFileHandler(fileDir, pathPrefix)).Methods(http.MethodDelete)
+	}()).Methods(http.MethodDelete)
+	r.PathPrefix(pathPrefix).Handler(transferHandler(store, locks, pathPrefix, true, conf.Trash)).Methods("MOVE")
+	r.PathPrefix(pathPrefix).Handler(transferHandler(store, locks, pathPrefix, false, conf.Trash)).Methods("COPY")
 
 	// TODO: GZIP, CORS (if need)
 
-	return recoveryHandler(true, r)
+	return recoveryHandler(conf.OutputError, limitBodyMiddleware(conf.MaxBodySize, r))
 }
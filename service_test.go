@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestServiceStorages tests every Storage responses the same status codes
+func TestServiceStorages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Storage{
+		"disk":   NewDiskStorage(dir, false),
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, store := range stores {
+		h := service(store, newPathLocker(), defaultConfig())
+		testFunc := func(method, target, body string, expectCode int) {
+			var r io.Reader
+			if len(body) > 0 {
+				r = strings.NewReader(body)
+			}
+			req := httptest.NewRequest(method, target, r)
+			req.Header.Set("CONTENT-TYPE", jsonContentType)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != expectCode {
+				t.Errorf("Unexpected code, storage: %s, %s %s, want: %d, got: %d, body: %s", name, method, target, expectCode, w.Code, w.Body.String())
+			}
+		}
+
+		testFunc(http.MethodGet, "/news", "", http.StatusNotFound)
+		testFunc(http.MethodGet, "/news/", "", http.StatusNotFound)
+		testFunc(http.MethodPut, "/news/today", `{"Content":"hello"}`, http.StatusNotFound)
+		testFunc(http.MethodDelete, "/news/today", "", http.StatusNotFound)
+		testFunc(http.MethodPost, "/news/today", `{"Content":""}`, http.StatusBadRequest)
+		testFunc(http.MethodPost, "/news/today", `{"Content":"hello"}`, http.StatusOK)
+		testFunc(http.MethodPost, "/news/today", `{"Content":"hello"}`, http.StatusForbidden)
+		testFunc(http.MethodGet, "/news/today", "", http.StatusOK)
+		testFunc(http.MethodGet, "/news/", "", http.StatusOK)
+		testFunc(http.MethodGet, "/news/today/", "", http.StatusNotFound)
+		testFunc(http.MethodPut, "/news/today", `{"Content":"world"}`, http.StatusOK)
+		testFunc(http.MethodPut, "/news/", `{"Content":"world"}`, http.StatusNotFound)
+		testFunc(http.MethodDelete, "/news/today", "", http.StatusOK)
+		testFunc(http.MethodGet, "/news/today", "", http.StatusNotFound)
+	}
+}
+
+func TestServicePathPrefix(t *testing.T) {
+	store := NewMemoryStorage()
+	for _, prefix := range []string{"/api", "/api/"} {
+		conf := defaultConfig()
+		conf.PathPrefix = prefix
+		h := service(store, newPathLocker(), conf)
+		testFunc := func(method, target, body string, expectCode int) {
+			var r io.Reader
+			if len(body) > 0 {
+				r = strings.NewReader(body)
+			}
+			req := httptest.NewRequest(method, target, r)
+			req.Header.Set("CONTENT-TYPE", jsonContentType)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != expectCode {
+				t.Errorf("Unexpected code, prefix: %s, %s %s, want: %d, got: %d, body: %s", prefix, method, target, expectCode, w.Code, w.Body.String())
+			}
+		}
+
+		testFunc(http.MethodPost, "/apinews", `{"Content":"hello"}`, http.StatusNotFound)
+		testFunc(http.MethodGet, "/apinews", "", http.StatusNotFound)
+		testFunc(http.MethodPost, "/api/news", `{"Content":"hello"}`, http.StatusOK)
+		testFunc(http.MethodGet, "/api/news", "", http.StatusOK)
+		testFunc(http.MethodGet, "/api/", "", http.StatusOK)
+		testFunc(http.MethodDelete, "/api/news", "", http.StatusOK)
+		if _, err := store.Stat("/news.txt"); !os.IsNotExist(err) {
+			t.Errorf("Unexpected stat, prefix: %s, want: not exist, got: %v", prefix, err)
+		}
+	}
+}
+
+func TestServicePathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret.txt"), ([]byte)("secret"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(root, "link")); err != nil {
+		t.Skipf("Symlink is not supported, %v", err)
+	}
+
+	h := service(NewDiskStorage(root, false), newPathLocker(), defaultConfig())
+	testFunc := func(method, target string, expectCode int) {
+		req := httptest.NewRequest(method, target, strings.NewReader(`{"Content":"hacked"}`))
+		req.Header.Set("CONTENT-TYPE", jsonContentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectCode {
+			t.Errorf("Unexpected code, %s %s, want: %d, got: %d, body: %s", method, target, expectCode, w.Code, w.Body.String())
+		}
+	}
+
+	// Router redirects to the clean path, which is always under root
+	testFunc(http.MethodGet, "/%2e%2e/secret", http.StatusMovedPermanently)
+	testFunc(http.MethodGet, "/..%2fsecret", http.StatusMovedPermanently)
+	testFunc(http.MethodGet, "/%2e%2e%5csecret", http.StatusBadRequest)
+	testFunc(http.MethodGet, "/link/secret", http.StatusForbidden)
+	testFunc(http.MethodGet, "/link/", http.StatusForbidden)
+	testFunc(http.MethodPut, "/link/secret", http.StatusForbidden)
+	testFunc(http.MethodPost, "/link/new", http.StatusForbidden)
+	testFunc(http.MethodDelete, "/link/secret", http.StatusForbidden)
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "secret.txt")); err != nil || string(b) != "secret" {
+		t.Errorf("File outside of root should not be modified, content: %s, err: %v", b, err)
+	}
+}
+
+// TestServiceConcurrency hammers all verbs concurrently, run with -race to check handlers are race-free
+func TestServiceConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Storage{
+		"disk":   NewDiskStorage(dir, false),
+		"memory": NewMemoryStorage(),
+	}
+
+	const workers = 8
+	const rounds = 30
+	for name, store := range stores {
+		h := service(store, newPathLocker(), defaultConfig())
+		wg := sync.WaitGroup{}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				do := func(method, target, body string, expectCodes ...int) {
+					req := httptest.NewRequest(method, target, strings.NewReader(body))
+					req.Header.Set("CONTENT-TYPE", jsonContentType)
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, req)
+					for _, c := range expectCodes {
+						if w.Code == c {
+							return
+						}
+					}
+					t.Errorf("Unexpected code, storage: %s, %s %s, want: %v, got: %d, body: %s", name, method, target, expectCodes, w.Code, w.Body.String())
+				}
+
+				own := fmt.Sprintf("/news/worker-%d", i)
+				for j := 0; j < rounds; j++ {
+					do(http.MethodPost, own, `{"Content":"hello world"}`, http.StatusOK)
+					do(http.MethodGet, own, "", http.StatusOK)
+					do(http.MethodPut, own, `{"Content":"bye world"}`, http.StatusOK)
+					do(http.MethodGet, "/news/", "", http.StatusOK)
+					do(http.MethodDelete, own, "", http.StatusOK)
+
+					do(http.MethodPost, "/news/shared", `{"Content":"hello"}`, http.StatusOK, http.StatusForbidden)
+					do(http.MethodGet, "/news/shared", "", http.StatusOK, http.StatusNotFound)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+}
+
+// TestServiceAtomicCreate tests create-if-absent and remove-if-present are atomic under concurrent requests
+func TestServiceAtomicCreate(t *testing.T) {
+	h := service(NewMemoryStorage(), newPathLocker(), defaultConfig())
+
+	const workers = 16
+	count := func(method, body string) map[int]int {
+		mutex := sync.Mutex{}
+		codes := map[int]int{}
+		wg := sync.WaitGroup{}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest(method, "/news/today", strings.NewReader(body))
+				req.Header.Set("CONTENT-TYPE", jsonContentType)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				mutex.Lock()
+				codes[w.Code]++
+				mutex.Unlock()
+			}()
+		}
+		wg.Wait()
+		return codes
+	}
+
+	if codes := count(http.MethodPost, `{"Content":"hello"}`); codes[http.StatusOK] != 1 || codes[http.StatusForbidden] != workers-1 {
+		t.Errorf("Only one create should succeed, got: %v", codes)
+	}
+	if codes := count(http.MethodDelete, ""); codes[http.StatusOK] != 1 || codes[http.StatusNotFound] != workers-1 {
+		t.Errorf("Only one remove should succeed, got: %v", codes)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statCache caches partial aggregates of files by storage name, it is safe for concurrent use
+//
+// An entry is valid while the size and modification time of the file are unchanged, so files edited outside of the service are read again
+type statCache struct {
+	mutex sync.RWMutex
+	files map[string]statCacheEntry
+}
+
+type statCacheEntry struct {
+	size    int64
+	modTime time.Time
+	stat    *fileStat
+}
+
+func newStatCache() *statCache {
+	return &statCache{
+		files: map[string]statCacheEntry{},
+	}
+}
+
+// get returns the partial aggregate of the named file, if it is cached and the file is unchanged since
+func (c *statCache) get(name string, info os.FileInfo) (*fileStat, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	e, ok := c.files[name]
+	if !ok || e.size != info.Size() || !e.modTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	return e.stat, true
+}
+
+// set caches the partial aggregate of the named file, info is the file read for it
+func (c *statCache) set(name string, info os.FileInfo, f *fileStat) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.files[name] = statCacheEntry{info.Size(), info.ModTime(), f}
+}
+
+// remove removes the named file, or every file under the named folder
+func (c *statCache) remove(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	dir := strings.TrimSuffix(name, "/") + "/"
+	for key := range c.files {
+		if key == name || strings.HasPrefix(key, dir) {
+			delete(c.files, key)
+		}
+	}
+}
+
+// rename moves entries of the named file, or every file under the named folder, to the new name
+func (c *statCache) rename(oldName, newName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	oldDir := strings.TrimSuffix(oldName, "/") + "/"
+	newDir := strings.TrimSuffix(newName, "/") + "/"
+	moved := map[string]statCacheEntry{}
+	for key, e := range c.files {
+		switch {
+		case key == oldName || strings.HasPrefix(key, oldDir):
+			moved[key] = e
+			delete(c.files, key)
+		case key == newName || strings.HasPrefix(key, newDir):
+			// Replaced by the moved ones
+			delete(c.files, key)
+		}
+	}
+	for key, e := range moved {
+		if key == oldName {
+			c.files[newName] = e
+		} else {
+			c.files[newDir+strings.TrimPrefix(key, oldDir)] = e
+		}
+	}
+}
+
+// fileStatOf returns the partial aggregate and info of the named file from cache (nil to disable), the file is read and cached if it is not cached or changed
+func fileStatOf(store Storage, cache *statCache, name string) (*fileStat, os.FileInfo, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cache != nil {
+		if f, ok := cache.get(name, info); ok {
+			return f, info, nil
+		}
+	}
+	f, err := readFileStatOf(store, name, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cache != nil && !isReservedName(name) {
+		cache.set(name, info, f)
+	}
+	return f, info, nil
+}
+
+// openFileStat opens the named file, and returns its partial aggregate from cache (nil to disable) and its info, both of the content opened.
+// If it is not cached or changed, the file opened is read for it and rewound, so the file is read once
+//
+// The caller must close the file, and should lock the name shared, so the file is not replaced between Stat and Get
+func openFileStat(store Storage, cache *statCache, name string) (File, *fileStat, os.FileInfo, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	file, err := store.Get(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cache != nil {
+		if f, ok := cache.get(name, info); ok {
+			return file, f, info, nil
+		}
+	}
+
+	f := readFileStat(file, info.Size(), nil)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+	if cache != nil && !isReservedName(name) {
+		cache.set(name, info, f)
+	}
+	return file, f, info, nil
+}
+
+// wrap returns the Storage that updates the cache when files are written, removed or moved through it
+//
+// Content is aggregated while it is written, so files modified by the service are never read again for statistics
+func (c *statCache) wrap(store Storage) Storage {
+	return &statCachingStorage{store, c}
+}
+
+// statCachingStorage is a Storage that keeps statCache up to date, files under hidden folders (e.g. trash) are not cached
+type statCachingStorage struct {
+	Storage
+	cache *statCache
+}
+
+// isReservedName returns a boolean indicating whether the storage name is under a hidden folder, which is not reachable by the API
+func isReservedName(name string) bool {
+	return strings.Contains(name, "/.")
+}
+
+func (s *statCachingStorage) Put(name string, r io.Reader) error {
+	if isReservedName(name) {
+		return s.Storage.Put(name, r)
+	}
+
+	// Content written is aggregated at the same time
+	pr, pw := io.Pipe()
+	done := make(chan *fileStat, 1)
+	go func() {
+		done <- readFileStat(pr, 0, nil)
+	}()
+	err := s.Storage.Put(name, io.TeeReader(r, pw))
+	pw.Close()
+	f := <-done
+
+	// Entries are checked by size and modification time when used, so a failed write leaves the entry as is
+	if err != nil {
+		return err
+	}
+	if info, err := s.Storage.Stat(name); err == nil {
+		f.bytes = info.Size()
+		s.cache.set(name, info, f)
+	}
+	return nil
+}
+
+func (s *statCachingStorage) Delete(name string) error {
+	if err := s.Storage.Delete(name); err != nil {
+		return err
+	}
+	s.cache.remove(name)
+	return nil
+}
+
+func (s *statCachingStorage) Move(oldName, newName string) error {
+	if err := s.Storage.Move(oldName, newName); err != nil {
+		return err
+	}
+	if isReservedName(newName) {
+		s.cache.remove(oldName)
+	} else {
+		// Moving keeps modification time, so the entries are still valid
+		s.cache.rename(oldName, newName)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStorage is a Storage that counts Get calls and bytes read
+type countingStorage struct {
+	Storage
+	gets  int32
+	bytes int64
+}
+
+func (s *countingStorage) Get(name string) (File, error) {
+	atomic.AddInt32(&s.gets, 1)
+	f, err := s.Storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{f, &s.bytes}, nil
+}
+
+type countingFile struct {
+	File
+	bytes *int64
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	atomic.AddInt64(f.bytes, int64(n))
+	return n, err
+}
+
+func TestStatCache(t *testing.T) {
+	base := &countingStorage{Storage: NewMemoryStorage()}
+	cache := newStatCache()
+	store := cache.wrap(base)
+
+	for name, content := range map[string]string{
+		"/news/today.txt":    "hello world",
+		"/news/2018/old.txt": "sub folder",
+		"/a.txt":             "hi hi",
+		"/.trash/x.txt":      "trash",
+	} {
+		if err := store.Put(name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := cache.files["/.trash/x.txt"]; ok || len(cache.files) != 3 {
+		t.Errorf("Unexpected cache entries, want: 3, got: %d", len(cache.files))
+	}
+
+	testFunc := func(dirname string, expectGets int32) {
+		base.gets = 0
+		cached, err := dirStatistics(context.Background(), store, cache, dirname, &statOptions{depth: -1, workers: 2, extended: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if base.gets != expectGets {
+			t.Errorf("Unexpected reads, dirname: %s, want: %d, got: %d", dirname, expectGets, base.gets)
+		}
+		s, err := dirStatistics(context.Background(), base, nil, dirname, &statOptions{depth: -1, workers: 2, extended: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached.stat != s.stat {
+			t.Errorf("Unexpected cached stat, dirname: %s, want: %+v, got: %+v", dirname, s.stat, cached.stat)
+		}
+		if !reflect.DeepEqual(cached.Extended, s.Extended) {
+			t.Errorf("Unexpected cached extended stat, dirname: %s, want: %+v, got: %+v", dirname, s.Extended, cached.Extended)
+		}
+	}
+
+	testFunc("/", 0)
+	testFunc("/news/", 0)
+
+	// Modified outside of the cache, it is read once
+	if err := base.Put("/news/today.txt", strings.NewReader("modified outside")); err != nil {
+		t.Fatal(err)
+	}
+	testFunc("/", 1)
+	testFunc("/", 0)
+
+	if err := store.Move("/news/", "/archive/"); err != nil {
+		t.Fatal(err)
+	}
+	testFunc("/", 0)
+	if _, ok := cache.files["/archive/2018/old.txt"]; !ok {
+		t.Errorf("Unexpected cache entries, want: /archive/2018/old.txt, got: %v", cache.files)
+	}
+
+	if err := store.Move("/archive/today.txt", "/.trash/today.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.files) != 1 {
+		t.Errorf("Unexpected cache entries, want: 1, got: %v", cache.files)
+	}
+	testFunc("/", 0)
+
+	// Failed writes keep the entries
+	if err := store.Put("/archive/", strings.NewReader("folder")); err == nil {
+		t.Fatal("Should fail")
+	}
+	if err := store.Put("/archive/2018/old.txt/x.txt", strings.NewReader("x")); err == nil {
+		t.Fatal("Should fail")
+	}
+	testFunc("/", 0)
+}
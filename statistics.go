@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
 	"os"
-	"path/filepath"
-
-	"github.com/montanaflynn/stats"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type stat struct {
@@ -19,49 +23,418 @@ type stat struct {
 	TotalBytes              int64
 }
 
-func dirStatistics(dirname string) (*stat, error) {
-	if info, err := os.Stat(dirname); err != nil {
+// folderStat is the statistics of a folder, when computed recursively it covers the subtree, and Folders are statistics of sub folders
+type folderStat struct {
+	stat
+	Extended *extendedStat `json:",omitempty"`
+	Name     string        `json:",omitempty"`
+	Folders  []*folderStat `json:",omitempty"`
+}
+
+// extendedStat is the distributions of values, which are nil if there are no files (or words), and histograms
+type extendedStat struct {
+	WordLength           *distribution
+	NumAlphaCharsPerFile *distribution
+	FileSize             *distribution
+	WordLengthHistogram  []histogramBin
+	FileSizeHistogram    []histogramBin
+}
+
+// statOptions are options of folder statistics
+type statOptions struct {
+	depth    int  // levels of sub folders included, 0 means only files directly in the folder, and negative means the whole subtree
+	workers  int  // files read in parallel, the number of CPUs if not positive
+	extended bool // whether extendedStat is computed
+}
+
+// moments accumulates the count, sum and sum of squares of values, so mean and standard deviation can be merged without keeping values
+type moments struct {
+	n     int
+	sum   float64
+	sumSq float64
+}
+
+func (m *moments) add(x float64) {
+	m.n++
+	m.sum += x
+	m.sumSq += x * x
+}
+
+func (m *moments) merge(o moments) {
+	m.n += o.n
+	m.sum += o.sum
+	m.sumSq += o.sumSq
+}
+
+// mean returns the mean of values, or 0 if there are no values
+func (m moments) mean() float64 {
+	if m.n <= 0 {
+		return 0
+	}
+	return m.sum / float64(m.n)
+}
+
+// std returns the population standard deviation of values, or 0 if there are no values
+func (m moments) std() float64 {
+	if m.n <= 0 {
+		return 0
+	}
+	mean := m.mean()
+	// Rounding errors may make the variance slightly negative
+	return math.Sqrt(math.Max(m.sumSq/float64(m.n)-mean*mean, 0))
+}
+
+// fileStat is the partial aggregate of a file, which is merged into statistics of folders. ETag and the number of lines are kept for responses of the file
+type fileStat struct {
+	bytes        int64
+	alphaChars   int
+	wordLens     moments
+	wordLenCount []int // wordLenCount[l] is the number of words of length l
+	lines        int
+	etag         string
+}
+
+// statAccumulator merges partial aggregates of files into statistics
+//
+// Values of files are kept for extendedStat only if extended, since distributions cannot be merged without them
+type statAccumulator struct {
+	numFiles   int
+	totalBytes int64
+	alphaChars moments
+	wordLens   moments
+
+	extended     bool
+	wordLenCount []int
+	alphaCharsOf []float64
+	bytesOf      []int64
+}
+
+func (a *statAccumulator) add(f *fileStat) {
+	a.numFiles++
+	a.totalBytes += f.bytes
+	a.alphaChars.add(float64(f.alphaChars))
+	a.wordLens.merge(f.wordLens)
+	if a.extended {
+		a.wordLenCount = mergeCounts(a.wordLenCount, f.wordLenCount)
+		a.alphaCharsOf = append(a.alphaCharsOf, float64(f.alphaChars))
+		a.bytesOf = append(a.bytesOf, f.bytes)
+	}
+}
+
+func (a *statAccumulator) merge(o *statAccumulator) {
+	a.numFiles += o.numFiles
+	a.totalBytes += o.totalBytes
+	a.alphaChars.merge(o.alphaChars)
+	a.wordLens.merge(o.wordLens)
+	if a.extended {
+		a.wordLenCount = mergeCounts(a.wordLenCount, o.wordLenCount)
+		a.alphaCharsOf = append(a.alphaCharsOf, o.alphaCharsOf...)
+		a.bytesOf = append(a.bytesOf, o.bytesOf...)
+	}
+}
+
+// mergeCounts adds counts of o into counts and returns it, which grows if o is longer
+func mergeCounts(counts, o []int) []int {
+	for len(counts) < len(o) {
+		counts = append(counts, 0)
+	}
+	for i, c := range o {
+		counts[i] += c
+	}
+	return counts
+}
+
+func (a *statAccumulator) stat() stat {
+	return stat{
+		NumFiles:                a.numFiles,
+		AvgNumAlphaCharsPerFile: a.alphaChars.mean(),
+		StdNumAlphaCharsPerFile: a.alphaChars.std(),
+		AvgWordLength:           a.wordLens.mean(),
+		StdWordLength:           a.wordLens.std(),
+		TotalBytes:              a.totalBytes,
+	}
+}
+
+func (a *statAccumulator) extendedStat() *extendedStat {
+	bytes := make([]float64, len(a.bytesOf))
+	for i, b := range a.bytesOf {
+		bytes[i] = float64(b)
+	}
+	return &extendedStat{
+		WordLength:           countsDistribution(a.wordLenCount),
+		NumAlphaCharsPerFile: newDistribution(a.alphaCharsOf),
+		FileSize:             newDistribution(bytes),
+		WordLengthHistogram:  countsHistogram(a.wordLenCount),
+		FileSizeHistogram:    sizeHistogram(a.bytesOf),
+	}
+}
+
+// readFileStat reads the file and returns its partial aggregate, onWord is called with each word if it is not nil
+func readFileStat(r io.Reader, size int64, onWord func(string)) *fileStat {
+	f := &fileStat{bytes: size}
+	h := newETagHash()
+	lines := &lineCounter{}
+	reader := NewWordReader(io.TeeReader(r, io.MultiWriter(h, lines)))
+	for {
+		s, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		f.alphaChars += len(s)
+		f.wordLens.add(float64(len(s)))
+		for len(f.wordLenCount) <= len(s) {
+			f.wordLenCount = append(f.wordLenCount, 0)
+		}
+		f.wordLenCount[len(s)]++
+		if onWord != nil {
+			onWord(s)
+		}
+	}
+	f.lines = lines.Lines()
+	f.etag = hashETag(h)
+	return f
+}
+
+// readFileStatOf reads the named file and returns its partial aggregate, info is the file listed
+func readFileStatOf(store Storage, name string, info os.FileInfo) (*fileStat, error) {
+	f, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readFileStat(f, info.Size(), nil), nil
+}
+
+// fileStatistics is the statistics of a file, words and alphanumeric characters are counted the same as statistics of folders
+type fileStatistics struct {
+	NumAlphaChars  int
+	NumWords       int
+	AvgWordLength  float64
+	StdWordLength  float64
+	NumLines       int
+	NumSentences   int
+	NumUniqueWords int
+	TotalBytes     int64
+}
+
+// readFileStatistics reads the file and returns its statistics, unique words are case-insensitive
+func readFileStatistics(r io.Reader, size int64) *fileStatistics {
+	sentences := &sentenceCounter{}
+	words := map[string]struct{}{}
+	f := readFileStat(io.TeeReader(r, sentences), size, func(word string) {
+		words[strings.ToLower(word)] = struct{}{}
+	})
+	return &fileStatistics{
+		NumAlphaChars:  f.alphaChars,
+		NumWords:       f.wordLens.n,
+		AvgWordLength:  f.wordLens.mean(),
+		StdWordLength:  f.wordLens.std(),
+		NumLines:       f.lines,
+		NumSentences:   sentences.Sentences(),
+		NumUniqueWords: len(words),
+		TotalBytes:     f.bytes,
+	}
+}
+
+// sentenceCounter is a io.Writer that counts sentences written
+//
+// A sentence has letters or digits, and ends with '.', '!' or '?' (optionally followed by closing quotes or brackets) before white space or the end of content,
+// so "3.14" does not end a sentence
+type sentenceCounter struct {
+	sentences  int
+	inSentence bool
+	ending     bool
+}
+
+func (c *sentenceCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		switch {
+		case b == '.' || b == '!' || b == '?':
+			c.ending = c.inSentence
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if c.ending {
+				c.sentences++
+				c.inSentence, c.ending = false, false
+			}
+		case b == '"' || b == '\'' || b == ')' || b == ']':
+		default:
+			c.ending = false
+			if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b >= 0x80 {
+				c.inSentence = true
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Sentences returns the number of sentences, the last sentence may not end
+func (c *sentenceCounter) Sentences() int {
+	if c.inSentence {
+		return c.sentences + 1
+	}
+	return c.sentences
+}
+
+// dirStatistics returns the statistics of files in the folder
+//
+// Sub folders are included down to o.depth levels, the subtree is walked once, statistics of every included sub folder are returned in Folders.
+// Files cached by cache (nil to disable) are not read, others are read by o.workers in parallel, results are merged in order of names so they do not depend on scheduling.
+// It stops and returns the error of ctx if ctx is done
+func dirStatistics(ctx context.Context, store Storage, cache *statCache, dirname string, o *statOptions) (*folderStat, error) {
+	if info, err := store.Stat(dirname); err != nil {
 		return nil, err
 	} else if !info.IsDir() {
 		return nil, errors.New("Not folder")
 	}
 
-	s := &stat{}
-	files, err := ioutil.ReadDir(dirname)
+	jobs := make([]statJob, 0)
+	root, err := walkStatistics(store, cache, dirname, o.depth, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	workers := o.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if err := readFileStats(ctx, store, cache, jobs, workers); err != nil {
+		return nil, err
+	}
+	s, _ := root.merge(o.extended)
+	return s, nil
+}
+
+// statNode is a folder walked, files are partial aggregates of files in order, nil if not read (yet)
+type statNode struct {
+	name    string
+	files   []*fileStat
+	folders []*statNode
+}
+
+// statJob is a file to be read, the result is stored into files[index] of the node
+type statJob struct {
+	node  *statNode
+	index int
+	name  string
+	info  os.FileInfo
+}
+
+// walkStatistics lists the folder and returns the node of it, files not cached are appended to jobs
+func walkStatistics(store Storage, cache *statCache, dirname string, depth int, jobs *[]statJob) (*statNode, error) {
+	files, err := store.List(dirname)
 	if err != nil {
 		return nil, err
 	}
-	wordLens := make([]float64, 0)
-	alphaCharsPerFile := make([]float64, 0)
+
+	node := &statNode{}
 	for _, file := range files {
+		name := path.Join(dirname, file.Name())
 		if file.IsDir() {
+			if depth == 0 {
+				continue
+			}
+			sub, err := walkStatistics(store, cache, name+"/", depth-1, jobs)
+			if os.IsNotExist(err) {
+				// Removed after listed
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			sub.name = file.Name() + "/"
+			node.folders = append(node.folders, sub)
 			continue
 		}
-		s.NumFiles++
-		s.TotalBytes += file.Size()
 
-		f, err := os.Open(filepath.Join(dirname, "/", file.Name()))
-		if err != nil {
-			return nil, err
+		node.files = append(node.files, nil)
+		if cache != nil {
+			if f, ok := cache.get(name, file); ok {
+				node.files[len(node.files)-1] = f
+				continue
+			}
 		}
-		reader := NewWordReader(f)
-		alphaChars := float64(0)
-		for {
-			s, err := reader.Read()
-			if err == io.EOF {
-				break
+		*jobs = append(*jobs, statJob{node, len(node.files) - 1, name, file})
+	}
+	sort.Slice(node.folders, func(i, j int) bool {
+		return node.folders[i].name < node.folders[j].name
+	})
+	return node, nil
+}
+
+// readFileStats reads files of jobs by workers in parallel, files removed after listed are skipped
+//
+// It stops at the first error, or when ctx is done
+func readFileStats(ctx context.Context, store Storage, cache *statCache, jobs []statJob, workers int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan *statJob)
+	errs := make(chan error, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Panics are not recovered by recoveryHandler in other goroutines
+			defer func() {
+				if err := recover(); err != nil {
+					errs <- fmt.Errorf("%v", err)
+					cancel()
+				}
+			}()
+
+			for job := range ch {
+				f, err := readFileStatOf(store, job.name, job.info)
+				if os.IsNotExist(err) {
+					// Removed after listed
+					continue
+				} else if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				if cache != nil {
+					cache.set(job.name, job.info, f)
+				}
+				job.node.files[job.index] = f
 			}
-			n := float64(len(s))
-			alphaChars += n
-			wordLens = append(wordLens, n)
+		}()
+	}
+
+feed:
+	for i := range jobs {
+		select {
+		case ch <- &jobs[i]:
+		case <-ctx.Done():
+			break feed
 		}
-		alphaCharsPerFile = append(alphaCharsPerFile, alphaChars)
-		f.Close()
 	}
-	s.AvgNumAlphaCharsPerFile, _ = stats.Mean(alphaCharsPerFile)
-	s.StdNumAlphaCharsPerFile, _ = stats.StandardDeviation(alphaCharsPerFile)
-	s.AvgWordLength, _ = stats.Mean(wordLens)
-	s.StdWordLength, _ = stats.StandardDeviation(wordLens)
+	close(ch)
+	wg.Wait()
 
-	return s, nil
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	return ctx.Err()
+}
+
+// merge returns the statistics of the node, and the accumulator of it to be merged into the parent folder
+func (n *statNode) merge(extended bool) (*folderStat, *statAccumulator) {
+	s := &folderStat{Name: n.name}
+	acc := &statAccumulator{extended: extended}
+	for _, f := range n.files {
+		if f != nil {
+			acc.add(f)
+		}
+	}
+	for _, sub := range n.folders {
+		subStat, subAcc := sub.merge(extended)
+		s.Folders = append(s.Folders, subStat)
+		acc.merge(subAcc)
+	}
+	s.stat = acc.stat()
+	if extended {
+		s.Extended = acc.extendedStat()
+	}
+	return s, acc
 }
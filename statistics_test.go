@@ -1,40 +1,35 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 func TestDirStatistics(t *testing.T) {
-	dir, err := os.Getwd()
-	if err != nil {
-		t.Fatal(err)
-	}
-	dir = filepath.Join(dir, "/test.folder.34238sxe")
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(dir)
-
-	if err := os.MkdirAll(dir+"/a", os.ModePerm); err != nil {
+	store := NewMemoryStorage()
+	if err := store.Put("/a/a.txt", strings.NewReader("sub folder")); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := os.MkdirAll(dir+"/b", os.ModePerm); err != nil {
+	if err := store.Put("/b/b.txt", strings.NewReader("sub folder")); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := ioutil.WriteFile(filepath.Join(dir, "/a.txt"), ([]byte)("hi hi"), os.ModePerm); err != nil {
+	if err := store.Put("/a.txt", strings.NewReader("hi hi")); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := ioutil.WriteFile(filepath.Join(dir, "/b.txt"), ([]byte)("world"), os.ModePerm); err != nil {
+	if err := store.Put("/b.txt", strings.NewReader("world")); err != nil {
 		t.Fatal(err)
 	}
 
-	stat, err := dirStatistics(dir)
+	stat, err := dirStatistics(context.Background(), store, nil, "/", &statOptions{depth: 0, workers: 2})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -50,6 +45,203 @@ func TestDirStatistics(t *testing.T) {
 	}
 }
 
+func TestDirStatisticsRecursive(t *testing.T) {
+	store := NewMemoryStorage()
+	for name, content := range map[string]string{
+		"/a.txt":           "hi hi",
+		"/news/b.txt":      "world",
+		"/news/2018/c.txt": "sub folder",
+		"/news/2018/d.txt": "",
+		"/news/2019/e.txt": "abc",
+		"/other/f.txt":     "x",
+	} {
+		if err := store.Put(name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put("/empty/x.txt", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("/empty/x.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	testFunc := func(s *folderStat, name string, numFiles int, avgWordLength float64, folders int) {
+		if s.Name != name || s.NumFiles != numFiles || !floatEquals(s.AvgWordLength, avgWordLength) || len(s.Folders) != folders {
+			t.Errorf("Unexpected stat, want: %s %d %.2f %d, got: %s %d %.2f %d", name, numFiles, avgWordLength, folders, s.Name, s.NumFiles, s.AvgWordLength, len(s.Folders))
+		}
+	}
+
+	s, err := dirStatistics(context.Background(), store, nil, "/news/", &statOptions{depth: -1, workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFunc(s, "", 4, 4.25, 2)
+	if !floatEquals(s.AvgNumAlphaCharsPerFile, 4.25) || !floatEquals(s.StdNumAlphaCharsPerFile, 3.2691742076555053) || s.TotalBytes != 18 {
+		t.Errorf("Unexpected stat, got: %+v", s.stat)
+	}
+	testFunc(s.Folders[0], "2018/", 2, 4.5, 0)
+	testFunc(s.Folders[1], "2019/", 1, 3, 0)
+
+	s, err = dirStatistics(context.Background(), store, nil, "/", &statOptions{depth: 1, workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFunc(s, "", 3, 2.5, 3)
+	testFunc(s.Folders[0], "empty/", 0, 0, 0)
+	testFunc(s.Folders[1], "news/", 1, 5, 0)
+	testFunc(s.Folders[2], "other/", 1, 1, 0)
+
+	s, err = dirStatistics(context.Background(), store, nil, "/news/2018/", &statOptions{depth: -1, workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFunc(s, "", 2, 4.5, 0)
+	if !floatEquals(s.StdWordLength, 1.5) {
+		t.Errorf("Unexpected StdWordLength, want: 1.5, got: %.2f", s.StdWordLength)
+	}
+}
+
+func TestReadFileStatistics(t *testing.T) {
+	content := "Hello world. Hello, WORLD!\nIs pi 3.14? Yes\n"
+	s := readFileStatistics(strings.NewReader(content), int64(len(content)))
+	expect := fileStatistics{
+		NumAlphaChars:  27,
+		NumWords:       7,
+		AvgWordLength:  27.0 / 7,
+		StdWordLength:  1.3552618543578767,
+		NumLines:       2,
+		NumSentences:   4,
+		NumUniqueWords: 5,
+		TotalBytes:     int64(len(content)),
+	}
+	if s.NumAlphaChars != expect.NumAlphaChars || s.NumWords != expect.NumWords || !floatEquals(s.AvgWordLength, expect.AvgWordLength) || !floatEquals(s.StdWordLength, expect.StdWordLength) ||
+		s.NumLines != expect.NumLines || s.NumSentences != expect.NumSentences || s.NumUniqueWords != expect.NumUniqueWords || s.TotalBytes != expect.TotalBytes {
+		t.Errorf("Unexpected statistics, want: %+v, got: %+v", expect, *s)
+	}
+
+	// Files and folders are counted the same
+	store := NewMemoryStorage()
+	if err := store.Put("/a.txt", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	folder, err := dirStatistics(context.Background(), store, nil, "/", &statOptions{depth: 0, workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.AvgNumAlphaCharsPerFile != float64(s.NumAlphaChars) || folder.AvgWordLength != s.AvgWordLength || folder.StdWordLength != s.StdWordLength || folder.TotalBytes != s.TotalBytes {
+		t.Errorf("Unexpected folder statistics, want: %+v, got: %+v", *s, folder.stat)
+	}
+}
+
+func TestSentenceCounter(t *testing.T) {
+	testFunc := func(content string, expect int) {
+		c := &sentenceCounter{}
+		for _, b := range []byte(content) {
+			// Written byte by byte, so states are kept between writes
+			c.Write([]byte{b})
+		}
+		if got := c.Sentences(); got != expect {
+			t.Errorf("Unexpected sentences, content: %q, want: %d, got: %d", content, expect, got)
+		}
+	}
+
+	testFunc("", 0)
+	testFunc("   \n", 0)
+	testFunc("...", 0)
+	testFunc("Hello", 1)
+	testFunc("Hello.", 1)
+	testFunc("Hello. World", 2)
+	testFunc("Hello!! World? ", 2)
+	testFunc("Pi is 3.14.", 1)
+	testFunc("He said \"hi.\" Then left.", 2)
+	testFunc("(See above.)\nDone", 2)
+	testFunc("One.\n\n. Two.", 2)
+}
+
+// failingStorage is a Storage whose files fail to read
+type failingStorage struct {
+	Storage
+}
+
+func (s failingStorage) Get(name string) (File, error) {
+	f, err := s.Storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return failingFile{f}, nil
+}
+
+type failingFile struct {
+	File
+}
+
+func (f failingFile) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestDirStatisticsParallel(t *testing.T) {
+	store := NewMemoryStorage()
+	for i := 0; i < 200; i++ {
+		content := strings.Repeat(fmt.Sprintf("word%d abc de ", i), i%7+1)
+		if err := store.Put(fmt.Sprintf("/news/%d/%03d.txt", i%5, i), strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect, err := dirStatistics(context.Background(), store, nil, "/", &statOptions{depth: -1, workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{0, 2, 3, 16} {
+		s, err := dirStatistics(context.Background(), store, nil, "/", &statOptions{depth: -1, workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(s, expect) {
+			t.Errorf("Unexpected stat, workers: %d, want: %+v, got: %+v", workers, expect.stat, s.stat)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dirStatistics(ctx, store, nil, "/", &statOptions{depth: -1, workers: 4}); err != context.Canceled {
+		t.Errorf("Unexpected error, want: %v, got: %v", context.Canceled, err)
+	}
+
+	// Read errors panic in WordReader, which are returned as errors
+	if _, err := dirStatistics(context.Background(), failingStorage{store}, nil, "/", &statOptions{depth: -1, workers: 4}); err == nil {
+		t.Errorf("Should fail")
+	}
+}
+
+// BenchmarkDirStatistics reads a folder of thousands of files with different numbers of workers
+func BenchmarkDirStatistics(b *testing.B) {
+	dir, err := ioutil.TempDir("", "statistics")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStorage(dir, false)
+	content := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100)
+	for i := 0; i < 2000; i++ {
+		if err := store.Put(fmt.Sprintf("/news/%d/%d.txt", i%20, i), strings.NewReader(content)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := dirStatistics(context.Background(), store, nil, "/news/", &statOptions{depth: -1, workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func floatEquals(a, b float64) bool {
 	const EPSILON float64 = 0.00000001
 	return (a-b) < EPSILON && (b-a) < EPSILON
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Storage is the interface that stores text files and folders
+//
+// Names are slash-separated and rooted at "/", e.g. "/news/today.txt" is a file and "/news/" is a folder.
+// Errors about missing files or folders should satisfy os.IsNotExist
+type Storage interface {
+	// Stat returns the os.FileInfo describing the named file or folder
+	Stat(name string) (os.FileInfo, error)
+
+	// Get opens the named file for reading, the caller must close it
+	Get(name string) (File, error)
+
+	// Put writes the content read from r into the named file, creating parent folders if needed
+	Put(name string, r io.Reader) error
+
+	// Delete removes the named file or empty folder
+	Delete(name string) error
+
+	// Move renames the named file or folder to newName atomically, creating parent folders if needed.
+	// An existing file at newName is replaced, an existing folder is not
+	Move(oldName, newName string) error
+
+	// List returns the entries of the named folder sorted by name, hidden entries (names starting with ".") are excluded
+	List(name string) ([]os.FileInfo, error)
+}
+
+// File is the interface that reads a stored file
+//
+// The content does not change after opened, even if the file is replaced
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// copyAll copies the named file, or the folder with everything under it, to newName
+//
+// Each file is written atomically, but the folder is not copied atomically. Empty folders are not copied
+func copyAll(store Storage, name, newName string) error {
+	info, err := store.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		files, err := store.List(name)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := copyAll(store, path.Join(name, file.Name()), path.Join(newName, file.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.Put(newName, f)
+}
+
+// removeAll removes the named file, or the folder with everything under it, then returns the names removed
+//
+// Files are removed by deleteFile (e.g. store.Delete) before their folders, if dryRun is true, it only returns the names would be removed
+func removeAll(store Storage, name string, dryRun bool, deleteFile func(string) error) ([]string, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]string, 0)
+	if info.IsDir() {
+		name = strings.TrimSuffix(name, "/") + "/"
+		files, err := store.List(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			names, err := removeAll(store, path.Join(name, file.Name()), dryRun, deleteFile)
+			if err != nil {
+				return nil, err
+			}
+			removed = append(removed, names...)
+		}
+	}
+	if !dryRun {
+		remove := store.Delete
+		if !info.IsDir() {
+			remove = deleteFile
+		}
+		if err := remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return append(removed, name), nil
+}
+
+// pruneFolders removes the empty folder and its empty parent folders, except root. It stops at the first folder not empty
+//
+// Each folder is locked exclusively when removing, so the caller should not hold locks under it
+func pruneFolders(store Storage, locks *pathLocker, dir string) {
+	for ; dir != "/"; dir = parentFolders(dir)[0] {
+		if !func() bool {
+			unlock := locks.Lock(dir)
+			defer unlock()
+
+			files, err := store.List(dir)
+			if err != nil || len(files) > 0 {
+				return false
+			}
+			// Hidden files are not listed, removing fails if there are any
+			return store.Delete(dir) == nil
+		}() {
+			return
+		}
+	}
+}
+
+// NewDiskStorage returns a new Storage that stores files under root folder of local disk
+//
+// Relative root is resolved against the working directory once here, later changes of working directory do not affect it.
+// Symbolic links under root pointing outside of root are forbidden, unless followExternalSymlinks is true
+func NewDiskStorage(root string, followExternalSymlinks bool) Storage {
+	if len(root) <= 0 {
+		panic("root should not be empty")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		panic(err)
+	}
+	realRoot, err := realPath(root)
+	if err != nil {
+		panic(fmt.Sprintf("invalid root %s: %v", root, err))
+	}
+	return &diskStorage{
+		root:                   root,
+		realRoot:               realRoot,
+		followExternalSymlinks: followExternalSymlinks,
+	}
+}
+
+// diskStorage is immutable after created, so it is safe for concurrent use
+type diskStorage struct {
+	root                   string
+	realRoot               string
+	followExternalSymlinks bool
+}
+
+// path converts the storage name to physical file path
+func (s *diskStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// resolve converts the storage name to physical file path, and checks the path does not escape root through symbolic links
+func (s *diskStorage) resolve(op, name string) (string, error) {
+	fileName := s.path(name)
+	if s.followExternalSymlinks {
+		return fileName, nil
+	}
+
+	real, err := realPath(fileName)
+	if err == errDanglingSymlink || err == nil && !isWithin(s.realRoot, real) {
+		return "", &os.PathError{Op: op, Path: name, Err: errForbiddenPath}
+	} else if err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+func (s *diskStorage) Stat(name string) (os.FileInfo, error) {
+	fileName, err := s.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(fileName)
+}
+
+func (s *diskStorage) Get(name string) (File, error) {
+	fileName, err := s.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fileName)
+}
+
+// Put writes to a hidden temporary file in the same folder, then renames it into place, so readers never see a partially written file
+func (s *diskStorage) Put(name string, r io.Reader) error {
+	fileName, err := s.resolve("open", name)
+	if err != nil {
+		return err
+	}
+	dirName := filepath.Dir(fileName)
+	if err := os.MkdirAll(dirName, os.ModePerm); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(fileName); err == nil {
+		if info.IsDir() {
+			return &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		mode = info.Mode().Perm()
+	}
+
+	file, err := ioutil.TempFile(dirName, "."+filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	tempName := file.Name()
+	err = func() error {
+		defer file.Close()
+		if _, err := io.Copy(file, r); err != nil {
+			return err
+		}
+		if err := file.Chmod(mode); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		return file.Close()
+	}()
+	if err == nil {
+		err = os.Rename(tempName, fileName)
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	return syncDir(dirName)
+}
+
+func (s *diskStorage) Delete(name string) error {
+	fileName, err := s.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fileName)
+}
+
+func (s *diskStorage) Move(oldName, newName string) error {
+	oldFileName, err := s.resolve("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newFileName, err := s.resolve("rename", newName)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(oldFileName)
+	if err != nil {
+		return err
+	}
+	if newInfo, err := os.Stat(newFileName); err == nil && (info.IsDir() || newInfo.IsDir()) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrExist}
+	}
+	if info.IsDir() && isWithin(oldFileName, newFileName) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errors.New("destination is inside source")}
+	}
+
+	newDirName := filepath.Dir(newFileName)
+	if err := os.MkdirAll(newDirName, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(oldFileName, newFileName); err != nil {
+		return err
+	}
+	if err := syncDir(newDirName); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(oldFileName))
+}
+
+func (s *diskStorage) List(name string) ([]os.FileInfo, error) {
+	fileName, err := s.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	visibles := files[:0]
+	for _, file := range files {
+		if !isHiddenName(file.Name()) {
+			visibles = append(visibles, file)
+		}
+	}
+	return visibles, nil
+}
+
+// syncDir commits the entries of the folder (e.g. renamed files) to disk
+func syncDir(dirName string) error {
+	dir, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
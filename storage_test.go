@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewDiskStorage(dir, false)
+	testStorage(t, s)
+
+	if err := s.Put("/news/today.txt", strings.NewReader("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "/news/today.txt")); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "bye" {
+		t.Errorf("Content is not same, want: bye, got: %s", b)
+	}
+}
+
+// failingReader returns some data then fails
+type failingReader struct {
+	data string
+	read bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, errors.New("connection reset")
+	}
+	r.read = true
+	return copy(p, r.data), nil
+}
+
+func TestDiskStorageAtomicPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewDiskStorage(dir, false)
+	if err := s.Put("/news/today.txt", strings.NewReader("original")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put("/news/today.txt", &failingReader{data: "torn"}); err == nil {
+		t.Fatal("Put should fail")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "news", "today.txt")); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "original" {
+		t.Errorf("Failed put should keep the original content, got: %s", b)
+	}
+
+	if err := s.Put("/news/new.txt", &failingReader{data: "torn"}); err == nil {
+		t.Fatal("Put should fail")
+	}
+	if _, err := s.Stat("/news/new.txt"); !os.IsNotExist(err) {
+		t.Errorf("Failed put should not create the file, %v", err)
+	}
+
+	if files, err := ioutil.ReadDir(filepath.Join(dir, "news")); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 {
+		t.Errorf("Temporary files should be removed, got %d files", len(files))
+	}
+
+	if err := os.Chmod(filepath.Join(dir, "news", "today.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/news/today.txt", strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "news", "today.txt")); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("Put should keep the file mode, want: 0600, got: %v", info.Mode().Perm())
+	}
+
+	// Readers should see either the old or the new content
+	contents := []string{strings.Repeat("a", 64<<10), strings.Repeat("b", 64<<10)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if err := s.Put("/news/today.txt", strings.NewReader(contents[i%2])); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		f, err := s.Get("/news/today.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if c := string(b); c != contents[0] && c != contents[1] && c != "replaced" {
+			t.Fatalf("Read a torn file, size: %d", len(b))
+		}
+	}
+}
+
+// testStorage tests the behaviors every Storage should have, s should be empty
+func testStorage(t *testing.T, s Storage) {
+	if _, err := s.Stat("/news/today.txt"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error, want: not exist, got: %v", err)
+	}
+
+	if err := s.Put("/news/today.txt", strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := s.Stat("/news/"); err != nil {
+		t.Fatal(err)
+	} else if !info.IsDir() {
+		t.Errorf("Should be folder, %s", info.Name())
+	}
+
+	if info, err := s.Stat("/news/today.txt"); err != nil {
+		t.Fatal(err)
+	} else if info.IsDir() || info.Size() != 11 {
+		t.Errorf("Unexpected file info, dir: %v, size: %d", info.IsDir(), info.Size())
+	}
+
+	if f, err := s.Get("/news/today.txt"); err != nil {
+		t.Fatal(err)
+	} else {
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(b) != "hello world" {
+			t.Errorf("Content is not same, want: hello world, got: %s", b)
+		}
+	}
+
+	if err := s.Put("/news/today.txt", strings.NewReader("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.Stat("/news/today.txt"); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 3 {
+		t.Errorf("Unexpected size, want: 3, got: %d", info.Size())
+	}
+
+	if info, err := s.Stat("/"); err != nil {
+		t.Fatal(err)
+	} else if !info.IsDir() {
+		t.Errorf("Root should be folder")
+	}
+	if _, err := s.List("/none/"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error, want: not exist, got: %v", err)
+	}
+	if err := s.Put("/news/today.txt/a.txt", strings.NewReader("a")); err == nil {
+		t.Errorf("Put under a file should fail")
+	}
+	if err := s.Put("/news/", strings.NewReader("a")); err == nil {
+		t.Errorf("Put to a folder should fail")
+	}
+
+	if err := s.Put("/news/2018/old.txt", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/news/.hidden.txt", strings.NewReader("hidden")); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := s.List("/news/"); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 || files[0].Name() != "2018" || files[1].Name() != "today.txt" {
+		t.Errorf("Unexpected entries, %v", files)
+	}
+
+	if err := s.Delete("/news/today.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("/news/today.txt"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error, want: not exist, got: %v", err)
+	}
+	if _, err := s.Get("/news/today.txt"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error, want: not exist, got: %v", err)
+	}
+	if err := s.Delete("/news/today.txt"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error, want: not exist, got: %v", err)
+	}
+
+	if err := s.Delete("/news/"); err == nil {
+		t.Errorf("Delete a non-empty folder should fail")
+	}
+	if err := s.Delete("/news/.hidden.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("/news/2018/old.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("/news/2018/"); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := s.List("/news/"); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Errorf("Unexpected entries, %v", files)
+	}
+
+	testStorageMove(t, s)
+}
+
+// testStorageMove tests Move of files and folders
+func testStorageMove(t *testing.T, s Storage) {
+	expectContent := func(name, expect string) {
+		if b, err := readFile(s, name); err != nil {
+			t.Errorf("Read %s failed, %v", name, err)
+		} else if string(b) != expect {
+			t.Errorf("Content is not same, name: %s, want: %s, got: %s", name, expect, b)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"/move/a.txt":       "a",
+		"/move/b.txt":       "b",
+		"/move/sub/c.txt":   "c",
+		"/move/sub/d/e.txt": "e",
+	} {
+		if err := s.Put(name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Move("/move/a.txt", "/move/new/a2.txt"); err != nil {
+		t.Fatal(err)
+	}
+	expectContent("/move/new/a2.txt", "a")
+	if _, err := s.Stat("/move/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error, want: not exist, got: %v", err)
+	}
+
+	// Existing file is replaced
+	if err := s.Move("/move/b.txt", "/move/new/a2.txt"); err != nil {
+		t.Fatal(err)
+	}
+	expectContent("/move/new/a2.txt", "b")
+
+	if err := s.Move("/move/sub/", "/moved/sub2/"); err != nil {
+		t.Fatal(err)
+	}
+	expectContent("/moved/sub2/c.txt", "c")
+	expectContent("/moved/sub2/d/e.txt", "e")
+	if _, err := s.Stat("/move/sub/"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error, want: not exist, got: %v", err)
+	}
+
+	if err := s.Move("/move/none.txt", "/move/x.txt"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error, want: not exist, got: %v", err)
+	}
+	if err := s.Move("/moved/sub2/", "/move/new/"); !os.IsExist(err) {
+		t.Errorf("Move to existing folder should fail, got: %v", err)
+	}
+	if err := s.Move("/moved/sub2/c.txt", "/moved/sub2/d/"); !os.IsExist(err) {
+		t.Errorf("Move file to existing folder should fail, got: %v", err)
+	}
+	if err := s.Move("/moved/", "/moved/sub2/inner/"); err == nil {
+		t.Errorf("Move folder into itself should fail")
+	}
+	if err := s.Move("/moved/sub2/c.txt", "/move/new/a2.txt/c.txt"); err == nil {
+		t.Errorf("Move under a file should fail")
+	}
+	expectContent("/moved/sub2/c.txt", "c")
+}
+
+func TestDiskStorageSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "inside"), outside} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.txt"), ([]byte)("secret"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "inside", "public.txt"), ([]byte)("public"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"out":         outside,
+		"out-rel":     "../outside",
+		"secret.txt":  filepath.Join(outside, "secret.txt"),
+		"in":          filepath.Join(root, "inside"),
+		"public.txt":  "inside/public.txt",
+		"dangling":    filepath.Join(dir, "none"),
+		"parent":      "..",
+		"inside/loop": "../out",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("Symlink is not supported, %v", err)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		expectForbidden bool
+	}{
+		{"/", false},
+		{"/inside/", false},
+		{"/inside/public.txt", false},
+		{"/in/public.txt", false},
+		{"/public.txt", false},
+		{"/in/new/file.txt", false},
+		{"/new/file.txt", false},
+		{"/out/", true},
+		{"/out/secret.txt", true},
+		{"/out/new.txt", true},
+		{"/out-rel/secret.txt", true},
+		{"/secret.txt", true},
+		{"/dangling", true},
+		{"/dangling/new.txt", true},
+		{"/parent/outside/secret.txt", true},
+		{"/inside/loop/secret.txt", true},
+	}
+
+	s := NewDiskStorage(root, false)
+	for _, test := range tests {
+		_, err := s.Stat(test.name)
+		if isForbiddenPath(err) != test.expectForbidden {
+			t.Errorf("Unexpected stat result, name: %s, expect forbidden: %v, got: %v", test.name, test.expectForbidden, err)
+		}
+		if test.expectForbidden {
+			if _, err := s.Get(test.name); !isForbiddenPath(err) {
+				t.Errorf("Get should be forbidden, name: %s, got: %v", test.name, err)
+			}
+			if err := s.Put(test.name, strings.NewReader("hacked")); !isForbiddenPath(err) {
+				t.Errorf("Put should be forbidden, name: %s, got: %v", test.name, err)
+			}
+			if err := s.Delete(test.name); !isForbiddenPath(err) {
+				t.Errorf("Delete should be forbidden, name: %s, got: %v", test.name, err)
+			}
+			if _, err := s.List(test.name); !isForbiddenPath(err) {
+				t.Errorf("List should be forbidden, name: %s, got: %v", test.name, err)
+			}
+		}
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(outside, "secret.txt")); err != nil || string(b) != "secret" {
+		t.Errorf("File outside of root should not be modified, content: %s, err: %v", b, err)
+	}
+
+	// Follow symbolic links when configured
+	s = NewDiskStorage(root, true)
+	if _, err := s.Stat("/out/secret.txt"); err != nil {
+		t.Errorf("Should follow external symbolic link, %v", err)
+	}
+
+	// Root itself can be a symbolic link
+	s = NewDiskStorage(filepath.Join(root, "in"), false)
+	if _, err := s.Stat("/public.txt"); err != nil {
+		t.Errorf("Root can be symbolic link, %v", err)
+	}
+}
+
+func TestDiskStorageRelativeRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	s := NewDiskStorage("./files", false)
+	if err := s.Put("/a.txt", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing working directory should not affect the root
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("/a.txt"); err != nil {
+		t.Errorf("Root should be resolved when created, %v", err)
+	}
+	if err := s.Put("/b.txt", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files", "b.txt")); err != nil {
+		t.Errorf("File should be written under the root, %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes the certificate and private key in PEM
+func writeCert(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPEM, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateSelfSignedCert(t *testing.T) {
+	cert, err := generateSelfSignedCert([]string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := cert.Leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if err := cert.Leaf.VerifyHostname("example.com"); err == nil {
+		t.Errorf("Should not be valid for example.com")
+	}
+
+	if _, err := generateSelfSignedCert(nil, time.Hour); err == nil {
+		t.Errorf("Should fail without hosts")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	first, err := generateSelfSignedCert([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, first, certFile, keyFile)
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := r.GetCertificate(nil); string(c.Certificate[0]) != string(first.Certificate[0]) {
+		t.Errorf("Unexpected certificate, should be the first one")
+	}
+
+	second, err := generateSelfSignedCert([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, second, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	if c, _ := r.GetCertificate(nil); string(c.Certificate[0]) != string(second.Certificate[0]) {
+		t.Errorf("Unexpected certificate, should be reloaded")
+	}
+
+	// Broken files keep the previous certificate
+	if err := ioutil.WriteFile(keyFile, ([]byte)("broken"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, future.Add(time.Minute), future.Add(time.Minute))
+	if c, err := r.GetCertificate(nil); err != nil || string(c.Certificate[0]) != string(second.Certificate[0]) {
+		t.Errorf("Unexpected certificate, should be kept, %v", err)
+	}
+
+	if _, err := newCertReloader(filepath.Join(dir, "none.pem"), keyFile); err == nil {
+		t.Errorf("Should fail without cert file")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientCert, err := generateSelfSignedCert([]string{"client"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	writeCert(t, clientCert, caFile, filepath.Join(dir, "client-key.pem"))
+
+	if c, err := newTLSConfig(defaultConfig()); err != nil || c != nil {
+		t.Errorf("TLS should be disabled by default, config: %v, err: %v", c, err)
+	}
+
+	conf := defaultConfig()
+	conf.TLSSelfSigned = true
+	conf.TLSClientCA = caFile
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(([]byte)("hello"))
+	}))
+	s.TLS = tlsConfig
+	s.StartTLS()
+	defer s.Close()
+
+	testFunc := func(certs []tls.Certificate, expectOK bool) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+		resp, err := client.Get(s.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != expectOK {
+			t.Errorf("Unexpected result, with client certificate: %v, got: %v", len(certs) > 0, err)
+		}
+	}
+
+	testFunc(nil, false)
+	testFunc([]tls.Certificate{clientCert}, true)
+
+	conf.TLSClientCA = filepath.Join(dir, "client-key.pem")
+	if _, err := newTLSConfig(conf); err == nil {
+		t.Errorf("Should fail without certificates in CA bundle")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trashFolder is the hidden folder that holds deleted files, each item is a content file <ID>.txt and a metadata file <ID>.json
+const trashFolder = "/.trash/"
+
+// sweepInterval is the interval of purging expired items in trash and revisions
+const sweepInterval = time.Hour
+
+var itemIDPattern = regexp.MustCompile(`^[0-9a-f]{16}-[0-9a-f]{16}$`)
+
+// trashItem is a file deleted into trash, Path is the original path in URL form, e.g. "/news/today"
+type trashItem struct {
+	ID        string
+	Path      string
+	DeletedAt time.Time
+	Operator  string
+	Size      int64
+}
+
+func (i *trashItem) contentName() string {
+	return trashFolder + i.ID + ".txt"
+}
+
+func (i *trashItem) metadataName() string {
+	return trashFolder + i.ID + ".json"
+}
+
+// newItemID returns a new ID of trash item or revision, IDs are ordered by time created
+func newItemID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%016x-%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+// trashFile moves the named text file into trash, revisions of the file are moved along with it
+//
+// Metadata is written before the content is moved, so the content in trash always has metadata
+func trashFile(store Storage, name, operator string) (*trashItem, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	item := &trashItem{
+		ID:        newItemID(),
+		Path:      strings.TrimSuffix(name, ".txt"),
+		DeletedAt: time.Now().UTC(),
+		Operator:  operator,
+		Size:      info.Size(),
+	}
+
+	b, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(item.metadataName(), bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	if err := store.Move(name, item.contentName()); err != nil {
+		store.Delete(item.metadataName())
+		return nil, err
+	}
+	if err := moveRevisions(store, name, item.contentName()); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// getTrashItem returns the item in trash, errors satisfy os.IsNotExist if the item does not exist
+func getTrashItem(store Storage, id string) (*trashItem, error) {
+	if !itemIDPattern.MatchString(id) {
+		return nil, &os.PathError{Op: "open", Path: trashFolder + id, Err: os.ErrNotExist}
+	}
+	f, err := store.Get(trashFolder + id + ".json")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	item := &trashItem{}
+	if err := json.Unmarshal(b, item); err != nil {
+		return nil, err
+	}
+	if _, err := store.Stat(item.contentName()); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// listTrash returns items in trash originally under the folder (in URL form, e.g. "/news/"), latest deleted first
+func listTrash(store Storage, dirname string) ([]*trashItem, error) {
+	items := make([]*trashItem, 0)
+	files, err := store.List(trashFolder)
+	if os.IsNotExist(err) {
+		return items, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		item, err := getTrashItem(store, strings.TrimSuffix(file.Name(), ".json"))
+		if os.IsNotExist(err) {
+			// Restored or purged after listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(item.Path, dirname) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID > items[j].ID
+	})
+	return items, nil
+}
+
+// restoreTrashItem moves the content and revisions of item to the named file, then removes the item
+//
+// The sweeper may purge the item concurrently, errors satisfy os.IsNotExist if the content is purged
+func restoreTrashItem(store Storage, item *trashItem, name string) error {
+	if err := store.Move(item.contentName(), name); err != nil {
+		return err
+	}
+	if err := moveRevisions(store, item.contentName(), name); err != nil {
+		return err
+	}
+	if err := store.Delete(item.metadataName()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// purgeTrashItem removes the item and its revisions permanently
+func purgeTrashItem(store Storage, item *trashItem) error {
+	if err := store.Delete(item.contentName()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := deleteRevisions(store, item.contentName()); err != nil {
+		return err
+	}
+	return store.Delete(item.metadataName())
+}
+
+// sweepTrash purges items deleted before the time, and returns the number of items purged
+func sweepTrash(store Storage, locks *pathLocker, before time.Time) (int, error) {
+	items, err := listTrash(store, "/")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, item := range items {
+		if !item.DeletedAt.Before(before) {
+			continue
+		}
+		// The item is locked as purgeTrashHandler does, and read again since it may be restored before locked
+		unlock := locks.Lock(item.contentName())
+		item, err := getTrashItem(store, item.ID)
+		if err == nil {
+			err = purgeTrashItem(store, item)
+		}
+		unlock()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// purgeTrash purges every item in trash, and returns the number of items purged
+func purgeTrash(store Storage) (int, error) {
+	items, err := listTrash(store, "/")
+	if err != nil {
+		return 0, err
+	}
+	return purgeTrashItems(store, items)
+}
+
+// purgeTrashItems purges the items, items removed concurrently are skipped
+func purgeTrashItems(store Storage, items []*trashItem) (int, error) {
+	n := 0
+	for _, item := range items {
+		if err := purgeTrashItem(store, item); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// runSweeper calls sweep with the time before which items are expired periodically until stop is closed, what names the items in logs
+func runSweeper(what string, retention, interval time.Duration, stop <-chan struct{}, sweep func(before time.Time) (int, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := sweep(time.Now().Add(-retention)); err != nil {
+			fmt.Fprintf(os.Stderr, "Sweep %s failed: %v\n", what, err)
+		} else if n > 0 {
+			fmt.Fprintf(os.Stdout, "Purged %d %s\n", n, what)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Storage{
+		"disk":   NewDiskStorage(dir, false),
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, store := range stores {
+		for _, fileName := range []string{"/news/today.txt", "/news/2018/old.txt", "/a.txt"} {
+			if err := store.Put(fileName, strings.NewReader("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		items := map[string]*trashItem{}
+		for _, fileName := range []string{"/news/today.txt", "/news/2018/old.txt", "/a.txt"} {
+			item, err := trashFile(store, fileName, "tool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Stat(fileName); !os.IsNotExist(err) {
+				t.Errorf("Unexpected stat, storage: %s, name: %s, want: not exist, got: %v", name, fileName, err)
+			}
+			items[fileName] = item
+		}
+
+		item, err := getTrashItem(store, items["/news/today.txt"].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Path != "/news/today" || item.Operator != "tool" || item.Size != 5 || item.DeletedAt.IsZero() {
+			t.Errorf("Unexpected item, storage: %s, got: %+v", name, item)
+		}
+		if _, err := getTrashItem(store, "../news/today"); !os.IsNotExist(err) {
+			t.Errorf("Unexpected error, storage: %s, want: not exist, got: %v", name, err)
+		}
+
+		testFunc := func(dirname string, expect string) {
+			list, err := listTrash(store, dirname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := make([]string, 0, len(list))
+			for _, item := range list {
+				paths = append(paths, item.Path)
+			}
+			if got := strings.Join(paths, ","); got != expect {
+				t.Errorf("Unexpected list, storage: %s, dirname: %s, want: %s, got: %s", name, dirname, expect, got)
+			}
+		}
+		testFunc("/", "/a,/news/2018/old,/news/today")
+		testFunc("/news/", "/news/2018/old,/news/today")
+		testFunc("/b/", "")
+
+		if err := restoreTrashItem(store, items["/news/today.txt"], "/news/today.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Stat("/news/today.txt"); err != nil {
+			t.Errorf("Unexpected stat, storage: %s, want: exist, got: %v", name, err)
+		}
+		testFunc("/", "/a,/news/2018/old")
+
+		n, err := sweepTrash(store, newPathLocker(), items["/a.txt"].DeletedAt)
+		if err != nil || n != 1 {
+			t.Errorf("Unexpected sweep, storage: %s, want: 1, got: %d, %v", name, n, err)
+		}
+		testFunc("/", "/a")
+
+		// Sweeping waits for the item locked
+		locks := newPathLocker()
+		unlock := locks.Lock(items["/a.txt"].contentName())
+		done := make(chan struct{})
+		go func() {
+			n, err = sweepTrash(store, locks, time.Now().Add(time.Second))
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Errorf("Unexpected sweep, storage: %s, want: waiting for lock, got: done", name)
+		case <-time.After(50 * time.Millisecond):
+		}
+		unlock()
+		<-done
+		if err != nil || n != 1 {
+			t.Errorf("Unexpected sweep, storage: %s, want: 1, got: %d, %v", name, n, err)
+		}
+		testFunc("/", "")
+		if files, err := store.List(trashFolder); err != nil || len(files) != 0 {
+			t.Errorf("Unexpected trash folder, storage: %s, want: empty, got: %d, %v", name, len(files), err)
+		}
+	}
+}
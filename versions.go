@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// versionsFolder is the hidden folder that holds prior revisions of files, revisions of "/news/today.txt" are under "/.versions/news/today.txt/"
+//
+// Each revision is a content file <ID>.txt and a metadata file <ID>.json. Revisions follow the file when it is moved (including into trash and back),
+// and are removed when it is removed permanently
+const versionsFolder = "/.versions/"
+
+// revision is a prior content of a file, Time is when the content was replaced and Operator is who replaced it
+type revision struct {
+	ID       string
+	Time     time.Time
+	Size     int64
+	Operator string
+}
+
+// versionPolicy is the retention policy of revisions per file, zero limit or retention means unlimited
+type versionPolicy struct {
+	limit     int
+	retention time.Duration
+}
+
+// revisionsFolder returns the folder that holds revisions of the named file, or of every file under the named folder
+func revisionsFolder(name string) string {
+	return versionsFolder + strings.Trim(name, "/") + "/"
+}
+
+func (r *revision) contentName(name string) string {
+	return revisionsFolder(name) + r.ID + ".txt"
+}
+
+func (r *revision) metadataName(name string) string {
+	return revisionsFolder(name) + r.ID + ".json"
+}
+
+// saveRevision copies the current content of the named file as a new revision
+//
+// Content is written before metadata, so a listed revision always has content
+func saveRevision(store Storage, name, operator string) (*revision, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rev := &revision{
+		ID:       newItemID(),
+		Time:     time.Now().UTC(),
+		Size:     info.Size(),
+		Operator: operator,
+	}
+	if err := store.Put(rev.contentName(name), f); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(rev)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(rev.metadataName(name), bytes.NewReader(b)); err != nil {
+		store.Delete(rev.contentName(name))
+		return nil, err
+	}
+	return rev, nil
+}
+
+// getRevision returns the revision of the named file, errors satisfy os.IsNotExist if the revision does not exist
+func getRevision(store Storage, name, id string) (*revision, error) {
+	if !itemIDPattern.MatchString(id) {
+		return nil, &os.PathError{Op: "open", Path: revisionsFolder(name) + id, Err: os.ErrNotExist}
+	}
+	return readRevision(store, revisionsFolder(name)+id+".json")
+}
+
+// readRevision reads the metadata file of revision
+func readRevision(store Storage, metadataName string) (*revision, error) {
+	f, err := store.Get(metadataName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	rev := &revision{}
+	if err := json.Unmarshal(b, rev); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// listRevisions returns revisions of the named file, latest first
+func listRevisions(store Storage, name string) ([]*revision, error) {
+	revs := make([]*revision, 0)
+	files, err := store.List(revisionsFolder(name))
+	if os.IsNotExist(err) {
+		return revs, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		rev, err := readRevision(store, revisionsFolder(name)+file.Name())
+		if os.IsNotExist(err) {
+			// Pruned after listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].ID > revs[j].ID
+	})
+	return revs, nil
+}
+
+// deleteRevision removes the revision of the named file
+//
+// Metadata is removed first, so the revision is never listed without content
+func deleteRevision(store Storage, name string, rev *revision) error {
+	if err := store.Delete(rev.metadataName(name)); err != nil {
+		return err
+	}
+	if err := store.Delete(rev.contentName(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteRevisions removes revisions of the named file, or of every file under the named folder
+func deleteRevisions(store Storage, name string) error {
+	if _, err := removeAll(store, revisionsFolder(name), false, store.Delete); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// moveRevisions moves revisions of the named file, or of every file under the named folder, to newName along with the file
+//
+// Revisions left at newName are removed first, so they are never attached to another file
+func moveRevisions(store Storage, oldName, newName string) error {
+	if err := deleteRevisions(store, newName); err != nil {
+		return err
+	}
+	if err := store.Move(revisionsFolder(oldName), revisionsFolder(newName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pruneRevisions removes revisions of the named file exceeding the limit or expired at now, and returns the number of revisions removed
+func pruneRevisions(store Storage, name string, p *versionPolicy, now time.Time) (int, error) {
+	revs, err := listRevisions(store, name)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i, rev := range revs {
+		if (p.limit <= 0 || i < p.limit) && (p.retention <= 0 || !rev.Time.Before(now.Add(-p.retention))) {
+			continue
+		}
+		if err := deleteRevision(store, name, rev); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// sweepVersions removes revisions under the folder (in versionsFolder) replaced before the time, and returns the number of revisions removed
+//
+// Revisions of files not modified recently are only removed by it, since pruneRevisions runs when files are modified
+func sweepVersions(store Storage, locks *pathLocker, dirname string, before time.Time) (int, error) {
+	files, err := store.List(dirname)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	name := "/" + strings.TrimSuffix(strings.TrimPrefix(dirname, versionsFolder), "/")
+	for _, file := range files {
+		if file.IsDir() {
+			m, err := sweepVersions(store, locks, path.Join(dirname, file.Name())+"/", before)
+			n += m
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		// The file is locked as its writers do, so the revision is not moved or pruned while it is deleted
+		unlock := locks.Lock(name)
+		deleted, err := sweepRevision(store, name, dirname+file.Name(), before)
+		unlock()
+		if err != nil {
+			return n, err
+		}
+		if deleted {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// sweepRevision removes the revision of the named file by its metadata file if it is replaced before the time, and returns whether it is removed
+func sweepRevision(store Storage, name, metadataName string, before time.Time) (bool, error) {
+	rev, err := readRevision(store, metadataName)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !rev.Time.Before(before) {
+		return false, nil
+	}
+	if err := deleteRevision(store, name, rev); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Storage{
+		"disk":   NewDiskStorage(dir, false),
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, store := range stores {
+		const fileName = "/news/today.txt"
+		if err := store.Put(fileName, strings.NewReader("one")); err != nil {
+			t.Fatal(err)
+		}
+		revs := make([]*revision, 0)
+		for _, content := range []string{"two", "three", "four"} {
+			rev, err := saveRevision(store, fileName, "tool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			revs = append(revs, rev)
+			if err := store.Put(fileName, strings.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		testFunc := func(expect string) {
+			list, err := listRevisions(store, fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents := make([]string, 0, len(list))
+			for _, rev := range list {
+				f, err := store.Get(rev.contentName(fileName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(f)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents = append(contents, string(b))
+			}
+			if got := strings.Join(contents, ","); got != expect {
+				t.Errorf("Unexpected revisions, storage: %s, want: %s, got: %s", name, expect, got)
+			}
+		}
+		testFunc("three,two,one")
+
+		rev, err := getRevision(store, fileName, revs[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev.Size != 3 || rev.Operator != "tool" || rev.Time.IsZero() {
+			t.Errorf("Unexpected revision, storage: %s, got: %+v", name, rev)
+		}
+		if _, err := getRevision(store, fileName, "../today"); !os.IsNotExist(err) {
+			t.Errorf("Unexpected error, storage: %s, want: not exist, got: %v", name, err)
+		}
+		if list, err := listRevisions(store, "/news/none.txt"); err != nil || len(list) != 0 {
+			t.Errorf("Unexpected revisions, storage: %s, want: empty, got: %d, %v", name, len(list), err)
+		}
+
+		if n, err := pruneRevisions(store, fileName, &versionPolicy{limit: 2}, time.Now()); err != nil || n != 1 {
+			t.Errorf("Unexpected prune, storage: %s, want: 1, got: %d, %v", name, n, err)
+		}
+		testFunc("three,two")
+		if n, err := pruneRevisions(store, fileName, &versionPolicy{retention: time.Hour}, revs[2].Time.Add(time.Hour)); err != nil || n != 1 {
+			t.Errorf("Unexpected prune, storage: %s, want: 1, got: %d, %v", name, n, err)
+		}
+		testFunc("three")
+
+		if n, err := sweepVersions(store, newPathLocker(), versionsFolder, revs[2].Time); err != nil || n != 0 {
+			t.Errorf("Unexpected sweep, storage: %s, want: 0, got: %d, %v", name, n, err)
+		}
+
+		// Sweeping waits for the file locked
+		locks := newPathLocker()
+		unlock := locks.Lock(fileName)
+		done := make(chan struct{})
+		go func() {
+			if n, err := sweepVersions(store, locks, versionsFolder, time.Now().Add(time.Second)); err != nil || n != 1 {
+				t.Errorf("Unexpected sweep, storage: %s, want: 1, got: %d, %v", name, n, err)
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Errorf("Unexpected sweep, storage: %s, want: waiting for lock, got: done", name)
+		case <-time.After(50 * time.Millisecond):
+		}
+		unlock()
+		<-done
+		testFunc("")
+	}
+}